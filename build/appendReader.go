@@ -24,13 +24,19 @@ import (
 	"os"
 	"io"
 	"io/ioutil"
+	"path/filepath"
+	"bytes"
+	"bufio"
+	"sort"
 	"compress/gzip"
+	"compress/zlib"
+	"compress/flate"
+	"crypto/sha256"
+	"hash"
+	"context"
+	"strings"
+	"sync"
 	"github.com/pkg/errors"
-	"encoding/json"
-	"encoding/binary"
-
-	"sync/atomic"
-	"github.com/yourfin/transcodebot/common"
 )
 
 // Type:
@@ -39,10 +45,52 @@ import (
 //  To provide an concurrent interface for reading
 //  files tacked on the end of a binary
 type BinAppendExtractor struct {
+	//Read blocks through a memory mapped view of the file instead
+	//of seeking and reading, which saves syscalls on lots of small reads.
+	//Mapping costs syscalls of its own, so reading many small blocks
+	//whole is faster without it; see the benchmarks in appendReader_test.go.
+	//Falls back to normal reads where mmap isn't available, or the
+	//file is too short for the block.
+	//Default false
+	UseMmap bool
+
+	//Directory to write temporary files to when extracting
+	//Default (empty) is os.TempDir()
+	TempDir string
+
+	//Size of the buffer between the file and each reader, which
+	//batches small sequential reads into fewer syscalls.
+	//Not used for blocks read through mmap.
+	//Default (0) is defaultReadBufferSize, negative turns buffering off
+	ReadBufferSize int
+
+	//Ignore case when looking up block names. Lookups fail if any two
+	//names in the file only differ by case.
+	//Default false
+	CaseInsensitive bool
+
 	filename string
-	metadata appendedMetadata
+	//The file the index lives in, same as filename unless using a sidecar
+	indexFilename string
+	//Read from instead of filename, if set by MakeAppendExtractorFromReaderAt
+	source io.ReaderAt
+	index  blockIndex
+	//Where the index starts in its file
+	indexPtr int64
+
+	//Lowercased name to real name, built on the first
+	//case insensitive lookup
+	foldedNames map[string]string
+	foldMux     sync.Mutex
+
+	//Contents of dictionary blocks that have been used so far
+	dictionaries  map[string][]byte
+	dictionaryMux sync.Mutex
 }
 
+//Default for BinAppendExtractor.ReadBufferSize
+const defaultReadBufferSize = 32 * 1024
+
 // Procedure:
 //  MakeAppendReader
 // Purpose:
@@ -57,59 +105,159 @@ type BinAppendExtractor struct {
 //  filename was appended to with by a BinAppender
 // Postconditions:
 //  reader is initialized to grab the files from files
+//  Json indexes are read in fully; binary indexes are searched
+//    on each call to GetReader
 func MakeAppendExtractor(filename string) (reader *BinAppendExtractor, err error) {
-	reader = &BinAppendExtractor{}
-	reader.filename = filename
-	fileHandle, err := os.Open(filename)
+	return makeAppendExtractor(filename, filename)
+}
+
+// Procedure:
+//  SelfExtractor
+// Purpose:
+//  To read the blocks packed onto the running executable
+// Parameters:
+//  None
+// Produces:
+//  A pointer to a BinAppendExtractor: reader *BinAppendExtractor
+//  Any errors finding or reading the executable: err error
+// Preconditions:
+//  The running executable was appended to by a BinAppender
+// Postconditions:
+//  reader reads from the file os.Executable names, with symlinks
+//    resolved, so a client run through a symlink finds its own blocks
+//    rather than the link's
+func SelfExtractor() (reader *BinAppendExtractor, err error) {
+	executable, err := os.Executable()
 	if err != nil {
-		_ = fileHandle.Close()
-		return nil, errors.Wrapf(err, "Open file \"%s\"", filename)
+		return nil, errors.Wrap(err, "finding executable")
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving executable")
 	}
+	return MakeAppendExtractor(executable)
+}
 
-	//Read in metadata pointer magic number
-	_, err = fileHandle.Seek(-8, io.SeekEnd)
+// Procedure:
+//  MakeStrictAppendExtractor
+// Purpose:
+//  To create a BinAppendExtractor for a file that must not have been
+//    truncated or had bytes slipped in among its blocks
+// Parameters:
+//  The file to open: filename string
+// Produces:
+//  A pointer to a BinAppendExtractor: reader *BinAppendExtractor
+//  Any errors that occur, including from CheckLength: err error
+// Preconditions:
+//  As for MakeAppendExtractor
+// Postconditions:
+//  As for MakeAppendExtractor, after CheckLength has passed
+//  Not the default, since tools that legitimately rewrite the
+//    end of a packed file would trip it
+func MakeStrictAppendExtractor(filename string) (reader *BinAppendExtractor, err error) {
+	reader, err = MakeAppendExtractor(filename)
 	if err != nil {
-		_ = fileHandle.Close()
-		return nil, errors.Wrapf(err, "Seek in file \"%s\" to location %d before end", filename, 8)
+		return nil, err
+	}
+	if err = reader.CheckLength(); err != nil {
+		return nil, err
 	}
+	return reader, nil
+}
+
+// Procedure:
+//  MakeSidecarExtractor
+// Purpose:
+//  To create a BinAppendExtractor for a file appended to by
+//    a BinAppender from MakeSidecarAppender
+// Parameters:
+//  The file holding the appended blocks: filename string
+//  The sidecar file holding the index: sidecarFilename string
+// Produces:
+//  A pointer to a BinAppendExtractor: reader *BinAppendExtractor
+//  Any errors that occur: err error
+// Preconditions:
+//  Both files exist on the filesystem
+//  sidecarFilename was written by the BinAppender that appended to filename
+// Postconditions:
+//  reader is initialized to grab the files from filename, looking
+//    them up in the index in sidecarFilename
+func MakeSidecarExtractor(filename string, sidecarFilename string) (reader *BinAppendExtractor, err error) {
+	return makeAppendExtractor(filename, sidecarFilename)
+}
 
-	metadataPtrBytes := make([]byte, 8)
-	count, err := fileHandle.Read(metadataPtrBytes)
+// Procedure:
+//  MakeAppendExtractorFromReaderAt
+// Purpose:
+//  To create a BinAppendExtractor for something already open,
+//    e.g. the running binary or a file cached in memory
+// Parameters:
+//  What to read the blocks and index from: source io.ReaderAt
+//  The size of source: size int64
+// Produces:
+//  A pointer to a BinAppendExtractor: reader *BinAppendExtractor
+//  Any errors reading the index: err error
+// Preconditions:
+//  source was appended to by a BinAppender
+//  source stays usable, and unchanged, while reader is in use
+// Postconditions:
+//  Everything is read from source with ReadAt, so calls may run
+//    concurrently if source allows concurrent ReadAt calls, as
+//    *os.File and *bytes.Reader do
+//  Blocks are read through io.SectionReaders; UseMmap only applies
+//    if source is an *os.File
+//  Nothing opens or closes files by name, so ExtractToFile and the
+//    like still work but CopyBlockTo, which takes a path, does not
+func MakeAppendExtractorFromReaderAt(source io.ReaderAt, size int64) (reader *BinAppendExtractor, err error) {
+	reader = &BinAppendExtractor{source: source}
+	reader.index, reader.indexPtr, err = readIndex(source, size)
 	if err != nil {
-		_ = fileHandle.Close()
-		return nil, errors.Wrap(err, "Read metadata pointer")
+		return nil, errors.Wrap(err, "Read index")
 	}
-	if count != 8 {
-		_ = fileHandle.Close()
-		return nil, errors.Errorf("Read %d bytes instead of 8 for metadata pointer location", count)
+	if !versionSupported(reader.index.version()) {
+		return nil, errors.Errorf(
+			"BinAppender reader versions %v do not include version \"%s\"",
+			SupportedVersions(),
+			reader.index.version(),
+		)
 	}
-	metadataPtr := int64(binary.LittleEndian.Uint64(metadataPtrBytes))
+	return reader, nil
+}
 
-	//Read in metadata
-	_, err = fileHandle.Seek(metadataPtr, io.SeekStart)
+//Shared implementation of MakeAppendExtractor and MakeSidecarExtractor
+func makeAppendExtractor(filename string, indexFilename string) (reader *BinAppendExtractor, err error) {
+	reader = &BinAppendExtractor{}
+	reader.filename = filename
+	reader.indexFilename = indexFilename
+	fileHandle, err := os.Open(indexFilename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Open file \"%s\"", indexFilename)
+	}
+
+	info, err := fileHandle.Stat()
 	if err != nil {
 		_ = fileHandle.Close()
-		return nil, errors.Wrapf(err, "Seek in file \"%s\" to location %d before end (metadata location)", filename, 8)
+		return nil, errors.Wrapf(err, "Stat file \"%s\"", indexFilename)
 	}
 
-	err = json.NewDecoder(fileHandle).Decode(&(reader.metadata))
+	reader.index, reader.indexPtr, err = readIndex(fileHandle, info.Size())
 	if err != nil {
 		_ = fileHandle.Close()
-		return nil, errors.Wrap(err, "Json Decode")
+		return nil, errors.Wrapf(err, "Read index of \"%s\"", indexFilename)
 	}
-	if reader.metadata.Version != METADATA_VERSION {
+	if !versionSupported(reader.index.version()) {
 		_ = fileHandle.Close()
 		return nil, errors.Errorf(
-			"BinAppender reader version \"%s\" does not match version \"%s\" on file \"%s\" ",
-			METADATA_VERSION,
-			reader.metadata.Version,
-			filename,
+			"BinAppender reader versions %v do not include version \"%s\" on file \"%s\" ",
+			SupportedVersions(),
+			reader.index.version(),
+			indexFilename,
 		)
 	}
 
 	err = fileHandle.Close()
 	if err != nil {
-		return nil, errors.Wrapf(err, "Closing %s", filename)
+		return nil, errors.Wrapf(err, "Closing %s", indexFilename)
 	}
 
 	return reader, nil
@@ -134,24 +282,542 @@ func MakeAppendExtractor(filename string) (reader *BinAppendExtractor, err error
 //   - When any filesystem errors in opening and seeking in the underlying binary
 //   - When $dataName does not match any names in the file
 func (extractor *BinAppendExtractor) GetReader(dataName string) (reader *BinAppendReader, err error) {
-	if _, exists := extractor.metadata.Data[dataName]; !exists {
+	return extractor.GetReaderContext(context.Background(), dataName)
+}
+
+// Procedure:
+//  *BinAppendExtractor.GetReaderContext
+// Purpose:
+//  To provide a reader as GetReader does, that can be cancelled
+// Parameters:
+//  The *BinAppendExtractor being called: extractor
+//  The context bounding the read: ctx context.Context
+//  The name of the data given: dataName string
+// Produces:
+//  A reader for the data by the same name: reader *BinAppendReader
+//  Errors produced: err error
+// Preconditions:
+//  dataName is a name that exists and has data associated with it
+// Postconditions:
+//  As for GetReader
+//  Once ctx is done, every Read on reader returns ctx.Err()
+//  The caller still closes reader
+func (extractor *BinAppendExtractor) GetReaderContext(ctx context.Context, dataName string) (reader *BinAppendReader, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	reader, data, err := extractor.openBlock(dataName)
+	if err != nil {
+		return nil, err
+	}
+	reader.dataReader, err = extractor.decompressor(data, reader.dataReader)
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	//Background and TODO contexts can never be cancelled
+	if ctx.Done() != nil {
+		reader.dataReader = &contextReader{ctx: ctx, reader: reader.dataReader}
+	}
+	return reader, nil
+}
+
+//Reader that stops with the context's error once it is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (reader *contextReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.reader.Read(p)
+}
+
+//Wraps the raw bytes of a block in whatever undoes its framing
+func (extractor *BinAppendExtractor) decompressor(data appendedData, raw io.Reader) (io.Reader, error) {
+	if data.Stored || data.Framing == FramingCustom {
+		return raw, nil
+	}
+	var dictionary []byte
+	if data.Dictionary != "" {
+		var err error
+		dictionary, err = extractor.dictionary(data.Dictionary)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading dictionary %s", data.Dictionary)
+		}
+	}
+	switch data.Framing {
+	case FramingGzip:
+		reader, err := gzip.NewReader(raw)
+		return reader, errors.Wrap(err, "creating gzip reader")
+	case FramingZlib:
+		reader, err := zlib.NewReaderDict(raw, dictionary)
+		return reader, errors.Wrap(err, "creating zlib reader")
+	case FramingDeflate:
+		return flate.NewReaderDict(raw, dictionary), nil
+	default:
+		return nil, errors.Errorf("unknown framing %q", data.Framing)
+	}
+}
+
+//The contents of the dictionary block dataName, read once and cached
+func (extractor *BinAppendExtractor) dictionary(dataName string) ([]byte, error) {
+	extractor.dictionaryMux.Lock()
+	defer extractor.dictionaryMux.Unlock()
+	if dictionary, cached := extractor.dictionaries[dataName]; cached {
+		return dictionary, nil
+	}
+	dictionary, err := extractor.ByteArray(dataName)
+	if err != nil {
+		return nil, err
+	}
+	if extractor.dictionaries == nil {
+		extractor.dictionaries = make(map[string][]byte)
+	}
+	extractor.dictionaries[dataName] = dictionary
+	return dictionary, nil
+}
+
+// Procedure:
+//  *BinAppendExtractor.GetRawReader
+// Purpose:
+//  To read a block exactly as it is stored in the file, without
+//    decompressing it, e.g. to forward it somewhere else
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name of the data given: dataName string
+// Produces:
+//  A reader over the stored bytes of the block: reader io.ReadCloser
+//  The number of bytes reader will produce: size int64
+//  Errors produced: err error
+// Preconditions:
+//  dataName is a name that exists and has data associated with it
+// Postconditions:
+//  reader produces the block as framed (gzip, zlib, or deflate), unless
+//    it was stored uncompressed; see Metadata to tell which
+//  The caller closes reader
+func (extractor *BinAppendExtractor) GetRawReader(dataName string) (reader io.ReadCloser, size int64, err error) {
+	rawReader, data, err := extractor.openBlock(dataName)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rawReader, data.ZippedSize, nil
+}
+
+// Procedure:
+//  CopyBlockTo
+// Purpose:
+//  To copy a region of a file as is, e.g. a block found with Metadata
+// Parameters:
+//  Where to copy to: writer io.Writer
+//  The file to copy from: path string
+//  Where the region starts in the file: start int64
+//  The length of the region: size int64
+// Produces:
+//  The number of bytes copied: n int64
+//  Any errors in reading or writing: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  Nothing is decompressed and nothing is written anywhere but writer
+//  err is non-nil if the file ends before start+size
+func CopyBlockTo(writer io.Writer, path string, start int64, size int64) (n int64, err error) {
+	if start < 0 || size < 0 {
+		return 0, errors.Errorf("Invalid block location %d or size %d", start, size)
+	}
+	fileHandle, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "opening block filehandle")
+	}
+	defer func() { _ = fileHandle.Close() }()
+	n, err = io.Copy(writer, io.NewSectionReader(fileHandle, start, size))
+	if err != nil {
+		return n, errors.Wrap(err, "copying block")
+	}
+	if n != size {
+		return n, errors.Errorf("File %s ended %d bytes into a %d byte block", path, n, size)
+	}
+	return n, nil
+}
+
+//Opens a BinAppendReader that reads the stored bytes of dataName,
+//along with the block's index entry
+func (extractor *BinAppendExtractor) openBlock(dataName string) (reader *BinAppendReader, data appendedData, err error) {
+	reader = &BinAppendReader{Name: dataName}
+	var file io.ReaderAt = extractor.source
+	if file == nil {
+		reader.fileHandle, err = os.Open(extractor.filename)
+		if err != nil {
+			return nil, data, errors.Wrap(err, "opening reader filehandle")
+		}
+		file = reader.fileHandle
+	}
+	data, exists, err := extractor.lookup(file, dataName)
+	if err != nil {
+		_ = reader.Close()
+		return nil, data, errors.Wrap(err, "looking up name in index")
+	}
+	if !exists {
+		_ = reader.Close()
+		return nil, data, errors.Errorf("Could not find name %s", dataName)
+	}
+	if data.StartFilePtr < 0 || data.ZippedSize < 0 {
+		_ = reader.Close()
+		return nil, data, errors.Errorf("Block %s has an invalid location %d or size %d", dataName, data.StartFilePtr, data.ZippedSize)
+	}
+	osFile, isOsFile := file.(*os.File)
+	if extractor.UseMmap && isOsFile && data.ZippedSize > 0 {
+		//Falls back to reading, e.g. if the file is too short for the
+		//block, where reading gives an error rather than a SIGBUS
+		mapped, unmap, err := mmapRegion(osFile, data.StartFilePtr, data.ZippedSize)
+		if err == nil {
+			reader.unmap = unmap
+			reader.dataReader = bytes.NewReader(mapped)
+		}
+	}
+	if reader.dataReader == nil {
+		reader.dataReader = io.NewSectionReader(file, data.StartFilePtr, data.ZippedSize)
+		if extractor.ReadBufferSize >= 0 {
+			bufferSize := extractor.ReadBufferSize
+			if bufferSize == 0 {
+				bufferSize = defaultReadBufferSize
+			}
+			//No point in a buffer bigger than the block
+			if int64(bufferSize) > data.ZippedSize {
+				bufferSize = int(data.ZippedSize)
+			}
+			reader.dataReader = bufio.NewReaderSize(reader.dataReader, bufferSize)
+		}
+	}
+	return reader, data, nil
+}
+
+//Returned by Size for blocks whose index entry doesn't say how big they
+//are uncompressed, e.g. from files packed before sizes were recorded
+var ErrSizeUnknown = errors.New("uncompressed size not recorded")
+
+// Procedure:
+//  *BinAppendExtractor.Size
+// Purpose:
+//  To find how big a block is without reading it, e.g. to decide
+//    whether to buffer or stream it
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name of the block: dataName string
+// Produces:
+//  The size of the data once decompressed: uncompressed int64
+//  The size of the block in the file: compressed int64
+//  Any errors reading the index, or if dataName doesn't exist: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  Only the index is read
+//  Stored blocks are the same size either way
+//  If the index has no uncompressed size for the block, uncompressed
+//    is -1, compressed is still set, and err is ErrSizeUnknown. Empty
+//    compressed blocks can't be told apart from these, so they are
+//    reported the same way.
+func (extractor *BinAppendExtractor) Size(dataName string) (uncompressed int64, compressed int64, err error) {
+	var file io.ReaderAt = extractor.source
+	if file == nil {
+		fileHandle, err := os.Open(extractor.filename)
+		if err != nil {
+			return -1, 0, errors.Wrap(err, "opening filehandle")
+		}
+		defer func() { _ = fileHandle.Close() }()
+		file = fileHandle
+	}
+	data, exists, err := extractor.lookup(file, dataName)
+	if err != nil {
+		return -1, 0, errors.Wrap(err, "looking up name in index")
+	}
+	if !exists {
+		return -1, 0, errors.Errorf("Could not find name %s", dataName)
+	}
+	if data.Stored {
+		return data.ZippedSize, data.ZippedSize, nil
+	}
+	if data.UnzippedSize == 0 {
+		return -1, data.ZippedSize, ErrSizeUnknown
+	}
+	return data.UnzippedSize, data.ZippedSize, nil
+}
+
+// Procedure:
+//  *BinAppendExtractor.Attributes
+// Purpose:
+//  To read back the key/value pairs appended with a block
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name of the block: dataName string
+// Produces:
+//  The block's attributes: attrs map[string]string
+//  Any errors reading the index, or if dataName doesn't exist: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  attrs is nil if the block has no attributes
+//  attrs is the extractor's own copy; the caller may change it
+func (extractor *BinAppendExtractor) Attributes(dataName string) (attrs map[string]string, err error) {
+	var file io.ReaderAt = extractor.source
+	if file == nil {
+		fileHandle, err := os.Open(extractor.filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening filehandle")
+		}
+		defer func() { _ = fileHandle.Close() }()
+		file = fileHandle
+	}
+	data, exists, err := extractor.lookup(file, dataName)
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up name in index")
+	}
+	if !exists {
 		return nil, errors.Errorf("Could not find name %s", dataName)
 	}
-	reader = &BinAppendReader{}
-	reader.fileHandle, err = os.Open(extractor.filename)
+	return copyAttributes(data.Attributes), nil
+}
+
+//A copy of attrs, nil if it is empty, so callers can't change an index
+func copyAttributes(attrs map[string]string) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	attrsCopy := make(map[string]string, len(attrs))
+	for key, value := range attrs {
+		attrsCopy[key] = value
+	}
+	return attrsCopy
+}
+
+//The format version the extractor's file was packed with,
+//one of SupportedVersions()
+func (extractor *BinAppendExtractor) FormatVersion() string {
+	return extractor.index.version()
+}
+
+// Procedure:
+//  *BinAppendExtractor.Has
+// Purpose:
+//  To cheaply check whether a block exists, e.g. to decide between
+//    an embedded resource and one on disk
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name to look for: dataName string
+// Produces:
+//  Whether dataName is in the index: found bool
+// Preconditions:
+//  No additional
+// Postconditions:
+//  With a json index, nothing is opened or read; binary indexes are
+//    searched as for GetReader
+//  Names are matched as for GetReader, including CaseInsensitive
+//  found is false if the index can't be read
+func (extractor *BinAppendExtractor) Has(dataName string) bool {
+	var file io.ReaderAt = extractor.source
+	if _, inMemory := extractor.index.(*jsonIndex); !inMemory && file == nil {
+		fileHandle, err := os.Open(extractor.filename)
+		if err != nil {
+			return false
+		}
+		defer func() { _ = fileHandle.Close() }()
+		file = fileHandle
+	}
+	_, found, err := extractor.lookup(file, dataName)
+	return err == nil && found
+}
+
+//Looks up dataName in the index, using file to read the index
+//unless it lives in a sidecar
+func (extractor *BinAppendExtractor) lookup(file io.ReaderAt, dataName string) (appendedData, bool, error) {
+	indexHandle := file
+	//Json indexes are already in memory, wherever they came from
+	_, inMemory := extractor.index.(*jsonIndex)
+	if extractor.indexFilename != extractor.filename && !inMemory {
+		sidecarHandle, err := os.Open(extractor.indexFilename)
+		if err != nil {
+			return appendedData{}, false, err
+		}
+		defer func() { _ = sidecarHandle.Close() }()
+		indexHandle = sidecarHandle
+	}
+	if extractor.CaseInsensitive {
+		foldedNames, err := extractor.foldNames(indexHandle)
+		if err != nil {
+			return appendedData{}, false, err
+		}
+		realName, found := foldedNames[strings.ToLower(dataName)]
+		if !found {
+			return appendedData{}, false, nil
+		}
+		dataName = realName
+	}
+	return extractor.index.lookup(indexHandle, dataName)
+}
+
+//Maps the lowercased version of every name in the index to the name,
+//reading the names from indexHandle the first time
+func (extractor *BinAppendExtractor) foldNames(indexHandle io.ReaderAt) (map[string]string, error) {
+	extractor.foldMux.Lock()
+	defer extractor.foldMux.Unlock()
+	if extractor.foldedNames != nil {
+		return extractor.foldedNames, nil
+	}
+	names, err := extractor.index.names(indexHandle)
 	if err != nil {
-		return nil, errors.Wrap(err, "opening reader filehandle")
+		return nil, err
+	}
+	foldedNames := make(map[string]string, len(names))
+	for _, name := range names {
+		folded := strings.ToLower(name)
+		if other, exists := foldedNames[folded]; exists {
+			return nil, errors.Errorf("Names %q and %q only differ by case, so can't be looked up case insensitively", other, name)
+		}
+		foldedNames[folded] = name
 	}
-	_, err = reader.fileHandle.Seek(extractor.metadata.Data[dataName].StartFilePtr, io.SeekStart)
+	extractor.foldedNames = foldedNames
+	return foldedNames, nil
+}
+
+// Procedure:
+//  *BinAppendExtractor.GetMultiReader
+// Purpose:
+//  To read several blocks one after another as a single stream
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The names of the blocks, in the order to read them: dataNames ...string
+// Produces:
+//  A reader over all of the blocks: reader io.ReadCloser
+//  Any errors opening the blocks: err error
+// Preconditions:
+//  Every name in dataNames exists in the extractor
+// Postconditions:
+//  Every block is opened before returning, so a missing name is
+//    reported here rather than partway through reading
+//  Closing reader closes every block's reader
+//  The caller closes reader
+func (extractor *BinAppendExtractor) GetMultiReader(dataNames ...string) (io.ReadCloser, error) {
+	output := &multiBlockReader{blocks: make([]*BinAppendReader, 0, len(dataNames))}
+	readers := make([]io.Reader, 0, len(dataNames))
+	for _, dataName := range dataNames {
+		block, err := extractor.GetReader(dataName)
+		if err != nil {
+			_ = output.Close()
+			return nil, err
+		}
+		output.blocks = append(output.blocks, block)
+		readers = append(readers, block)
+	}
+	output.Reader = io.MultiReader(readers...)
+	return output, nil
+}
+
+//Reads several blocks in a row and closes them all together
+type multiBlockReader struct {
+	io.Reader
+	blocks []*BinAppendReader
+}
+
+//Closes every block, returning the first error
+func (reader *multiBlockReader) Close() error {
+	var firstErr error
+	for _, block := range reader.blocks {
+		if err := block.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	reader.blocks = nil
+	return firstErr
+}
+
+// Procedure:
+//  *BinAppendExtractor.ListByPrefix
+// Purpose:
+//  To find every block under a path-like namespace, e.g. assets/icons/
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  What the names must start with: prefix string
+// Produces:
+//  The matching names, sorted: names []string
+//  Any errors reading the index: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  Names and prefix are both compared with forward slashes, whatever
+//    the platform, so assets\icons\ matches the same as assets/icons/
+//  The match is on the raw string, so assets/icon also matches
+//    assets/icons/x.png; end prefix in / to match whole directories
+//  The comparison ignores case if $extractor.CaseInsensitive
+//  An empty prefix lists every block
+func (extractor *BinAppendExtractor) ListByPrefix(prefix string) (names []string, err error) {
+	var indexHandle io.ReaderAt = extractor.source
+	if indexHandle == nil {
+		indexFile, err := os.Open(extractor.indexFilename)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening index filehandle")
+		}
+		defer func() { _ = indexFile.Close() }()
+		indexHandle = indexFile
+	}
+	allNames, err := extractor.index.names(indexHandle)
 	if err != nil {
-		return nil, errors.Wrap(err, "seeking in file")
+		return nil, errors.Wrap(err, "reading index")
 	}
-	limitReader := io.LimitReader(reader.fileHandle, extractor.metadata.Data[dataName].ZippedSize)
-	reader.gzReader, err = gzip.NewReader(limitReader)
+	prefix = normalizeBlockName(prefix, extractor.CaseInsensitive)
+	for _, name := range allNames {
+		if strings.HasPrefix(normalizeBlockName(name, extractor.CaseInsensitive), prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//name with forward slashes, lowercased if folding case
+func normalizeBlockName(name string, foldCase bool) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	if foldCase {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// Procedure:
+//  *BinAppendExtractor.OpenPrefix
+// Purpose:
+//  To open every block under a path-like namespace at once
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  What the names must start with: prefix string
+// Produces:
+//  A reader for each matching block, by name: readers map[string]*BinAppendReader
+//  Any errors reading the index or opening a block: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  Blocks match as for ListByPrefix
+//  If any block fails to open, the ones already opened are closed
+//    and readers is nil
+//  The caller closes every reader in readers
+func (extractor *BinAppendExtractor) OpenPrefix(prefix string) (readers map[string]*BinAppendReader, err error) {
+	names, err := extractor.ListByPrefix(prefix)
 	if err != nil {
-		return nil, errors.Wrap(err, "creating gzip reader")
+		return nil, err
 	}
-	return reader, nil
+	readers = make(map[string]*BinAppendReader, len(names))
+	for _, name := range names {
+		reader, err := extractor.GetReader(name)
+		if err != nil {
+			for _, opened := range readers {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		readers[name] = reader
+	}
+	return readers, nil
 }
 
 // Procedure:
@@ -171,10 +837,10 @@ func (extractor *BinAppendExtractor) GetReader(dataName string) (reader *BinAppe
 //  err will be a file system error, gzip error, or due to $dataName not existing
 func (extractor *BinAppendExtractor) ByteArray(dataName string) ([]byte, error) {
 	reader, err := extractor.GetReader(dataName)
-	defer func() { _ = reader.Close() }()
 	if err != nil {
 		return nil, errors.Wrap(err, "Generating reader for reading ByteArray")
 	}
+	defer func() { _ = reader.Close() }()
 
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
@@ -188,6 +854,579 @@ func (extractor *BinAppendExtractor) ByteArray(dataName string) ([]byte, error)
 	return data, nil
 }
 
+// Procedure:
+//  *BinAppendExtractor.ByteArrayWithHash
+// Purpose:
+//  To read all of a block of appended data to a byte array,
+//    hashing it on the way so it doesn't need to be read twice
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name of the data to retrieve: dataName string
+// Produces:
+//  The data named dataName: data []byte
+//  The SHA-256 of data: hash [sha256.Size]byte
+//  Any errors raised:       err error
+// Preconditions:
+//  The extractor is has some data named $dataName
+// Postconditions:
+//  hash covers the decompressed data, so it does not depend on
+//    how the block was stored
+//  err is as for ByteArray
+func (extractor *BinAppendExtractor) ByteArrayWithHash(dataName string) (data []byte, hash [sha256.Size]byte, err error) {
+	reader, err := extractor.GetReader(dataName)
+	if err != nil {
+		return nil, hash, errors.Wrap(err, "Generating reader for reading ByteArray")
+	}
+	defer func() { _ = reader.Close() }()
+
+	hasher := sha256.New()
+	data, err = ioutil.ReadAll(io.TeeReader(reader, hasher))
+	if err != nil {
+		return nil, hash, errors.Wrap(err, "Reading all data in")
+	}
+	copy(hash[:], hasher.Sum(nil))
+	return data, hash, nil
+}
+
+// Procedure:
+//  *BinAppendExtractor.ExtractToTempFile
+// Purpose:
+//  To decompress a block out to its own temporary file
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name of the data to extract: dataName string
+// Produces:
+//  The path of the temporary file: path string
+//  Any errors raised: err error
+// Preconditions:
+//  The extractor has some data named $dataName
+// Postconditions:
+//  The file at path is in $extractor.TempDir, or os.TempDir() if unset
+//  The file at path holds the data named $dataName
+//  err is returned before anything is extracted if the temp dir
+//    does not exist or cannot be written to
+//  If err is non-nil, no temporary file is left behind
+//  The caller removes the file at path
+func (extractor *BinAppendExtractor) ExtractToTempFile(dataName string) (path string, err error) {
+	tempDir, err := extractor.tempDir()
+	if err != nil {
+		return "", err
+	}
+	reader, err := extractor.GetReader(dataName)
+	if err != nil {
+		return "", errors.Wrap(err, "Generating reader for extraction")
+	}
+	defer func() { _ = reader.Close() }()
+
+	tempFile, err := ioutil.TempFile(tempDir, "transcodebot-")
+	if err != nil {
+		return "", errors.Wrap(err, "Creating temp file")
+	}
+	_, err = io.Copy(tempFile, reader)
+	if err == nil {
+		err = tempFile.Close()
+	}
+	if err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return "", errors.Wrapf(err, "Extracting %s to temp file", dataName)
+	}
+	return tempFile.Name(), nil
+}
+
+// Procedure:
+//  *BinAppendExtractor.ExtractToFile
+// Purpose:
+//  To decompress a block out to a file, restoring its permissions
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name of the data to extract: dataName string
+//  Where to write it: path string
+// Produces:
+//  Any errors raised: err error
+// Preconditions:
+//  The extractor has some data named $dataName
+// Postconditions:
+//  The file at path is created or overwritten with the data named $dataName
+//  The file has the permission bits recorded by AppendFile, regardless of umask
+//  If no permissions were recorded, it is 0755 if the data starts like
+//    an executable or script, and 0644 otherwise
+//  If err is non-nil, the file at path is removed
+func (extractor *BinAppendExtractor) ExtractToFile(dataName string, path string) error {
+	reader, data, err := extractor.openBlock(dataName)
+	if err != nil {
+		return errors.Wrap(err, "Generating reader for extraction")
+	}
+	defer func() { _ = reader.Close() }()
+	reader.dataReader, err = extractor.decompressor(data, reader.dataReader)
+	if err != nil {
+		return err
+	}
+
+	//Peek at the start to guess permissions for files without them
+	buffered := bufio.NewReader(reader)
+	mode := data.Mode
+	if mode == 0 {
+		mode = 0644
+		start, _ := buffered.Peek(4)
+		if looksExecutable(start) {
+			mode = 0755
+		}
+	}
+
+	outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.Wrapf(err, "Creating %s", path)
+	}
+	_, err = io.Copy(outFile, buffered)
+	if err == nil {
+		//OpenFile's mode is filtered by the umask and ignored if path existed
+		err = outFile.Chmod(mode)
+	}
+	if err == nil {
+		err = outFile.Close()
+	}
+	if err != nil {
+		_ = outFile.Close()
+		_ = os.Remove(path)
+		return errors.Wrapf(err, "Extracting %s to %s", dataName, path)
+	}
+	return nil
+}
+
+//Whether start is the beginning of an ELF, PE, or Mach-O binary, or a script
+func looksExecutable(start []byte) bool {
+	if bytes.HasPrefix(start, []byte("#!")) {
+		return true
+	}
+	for _, prefixes := range executableMagic {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(start, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Procedure:
+//  *BinAppendExtractor.tempDir
+// Purpose:
+//  To find and check the directory to put temporary files in
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+// Produces:
+//  The directory: tempDir string
+//  An error if it can't be used: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  tempDir is $extractor.TempDir, or os.TempDir() if unset
+//  err is non-nil if tempDir is not a directory or a file can't be created in it
+func (extractor *BinAppendExtractor) tempDir() (string, error) {
+	tempDir := extractor.TempDir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	info, err := os.Stat(tempDir)
+	if err != nil {
+		return "", errors.Wrap(err, "Checking temp dir")
+	}
+	if !info.IsDir() {
+		return "", errors.Errorf("Temp dir %s is not a directory", tempDir)
+	}
+	probe, err := ioutil.TempFile(tempDir, "transcodebot-probe-")
+	if err != nil {
+		return "", errors.Wrapf(err, "Temp dir %s is not writable", tempDir)
+	}
+	_ = probe.Close()
+	_ = os.Remove(probe.Name())
+	return tempDir, nil
+}
+
+//Exported description of a packed file, for tools that inspect the format
+type ArchiveMetadata struct {
+	//The MetadataVersion the file was packed with
+	Version string `json:"version"`
+	//Every block in the file, sorted by name
+	Blocks []BlockMetadata `json:"blocks"`
+}
+
+//Exported description of a single appended block
+type BlockMetadata struct {
+	Name string `json:"name"`
+	//Location of the start of the block in the file
+	StartFilePtr int64 `json:"start_file_pointer"`
+	//Size of the block in the file
+	ZippedSize int64 `json:"zipped_block_size"`
+	//Size of the data once decompressed, 0 if unknown
+	UnzippedSize int64 `json:"unzipped_size"`
+	//The block is not compressed
+	Stored bool `json:"stored"`
+	//Permission bits of the appended file, 0 if unknown
+	Mode os.FileMode `json:"mode"`
+	//gzip, zlib, or deflate; meaningless if Stored
+	Framing string `json:"framing"`
+	//As passed to AppendStreamReaderWithAttrs, nil if none
+	Attributes map[string]string `json:"attributes,omitempty"`
+	//Hex encoded hash of the uncompressed data, and which hash it is,
+	//empty if the block was packed without one
+	Checksum string   `json:"checksum,omitempty"`
+	HashAlgo HashAlgo `json:"hash_algo,omitempty"`
+	//ZippedSize over UnzippedSize, 0 if the uncompressed size is unknown.
+	//Near or above 1 means compressing the block isn't worth it.
+	Ratio float64 `json:"ratio"`
+}
+
+//compressed over uncompressed, 0 if uncompressed is unknown
+func compressionRatio(compressed int64, uncompressed int64) float64 {
+	if uncompressed <= 0 {
+		return 0
+	}
+	return float64(compressed) / float64(uncompressed)
+}
+
+// Procedure:
+//  *BinAppendExtractor.Metadata
+// Purpose:
+//  To describe the layout of the extractor's file
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+// Produces:
+//  A description of every block: metadata ArchiveMetadata
+//  Any errors reading the index: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  metadata is a copy; changing it does not affect the extractor
+//  Binary indexes are read in full to build metadata
+func (extractor *BinAppendExtractor) Metadata() (metadata ArchiveMetadata, err error) {
+	allMetadata, err := extractor.allMetadata()
+	if err != nil {
+		return metadata, err
+	}
+	metadata.Version = allMetadata.Version
+	metadata.Blocks = make([]BlockMetadata, 0, len(allMetadata.Data))
+	for name, data := range allMetadata.Data {
+		metadata.Blocks = append(metadata.Blocks, BlockMetadata{
+			Name:         name,
+			StartFilePtr: data.StartFilePtr,
+			ZippedSize:   data.ZippedSize,
+			UnzippedSize: data.UnzippedSize,
+			Stored:       data.Stored,
+			Mode:         data.Mode,
+			Framing:      data.Framing.ToString(),
+			Attributes:   copyAttributes(data.Attributes),
+			Checksum:     data.Checksum,
+			HashAlgo:     data.HashAlgo,
+			Ratio:        compressionRatio(data.ZippedSize, data.UnzippedSize),
+		})
+	}
+	sort.Slice(metadata.Blocks, func(ii, jj int) bool {
+		return metadata.Blocks[ii].Name < metadata.Blocks[jj].Name
+	})
+	return metadata, nil
+}
+
+//A block as listed by Manifest
+type ManifestEntry struct {
+	Name string `json:"name"`
+	//Size of the data once decompressed
+	Size int64 `json:"size"`
+	//Size of the block in the file
+	StoredSize int64 `json:"stored_size"`
+	//Hex encoded SHA-256 of the decompressed data, only set when
+	//hashing with HashSHA256
+	SHA256 string `json:"sha256,omitempty"`
+	//Hex encoded hash of the decompressed data, and which hash it is
+	Hash     string   `json:"hash"`
+	HashAlgo HashAlgo `json:"hash_algo"`
+	//StoredSize over Size, 0 for empty blocks
+	Ratio float64 `json:"ratio"`
+}
+
+// Procedure:
+//  *BinAppendExtractor.Manifest
+// Purpose:
+//  To list what is packed into the extractor's file, with SHA-256
+//    hashes, for tracking exactly what ships inside a binary
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+// Produces:
+//  An entry for every block, sorted by name: manifest []ManifestEntry
+//  Any errors reading or decompressing a block: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  As for ManifestWithHash with HashSHA256
+func (extractor *BinAppendExtractor) Manifest() (manifest []ManifestEntry, err error) {
+	return extractor.ManifestWithHash(HashSHA256)
+}
+
+// Procedure:
+//  *BinAppendExtractor.ManifestWithHash
+// Purpose:
+//  To list what is packed into the extractor's file, with hashes
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The hash to use: algo HashAlgo
+// Produces:
+//  An entry for every block, sorted by name: manifest []ManifestEntry
+//  Any errors reading or decompressing a block: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  err is non-nil if algo is unknown or HashNone
+//  Every block is read in full to hash it, one at a time, so this
+//    takes time but not memory proportional to the packed data
+//  Size is what was actually read, not what the index claims
+func (extractor *BinAppendExtractor) ManifestWithHash(algo HashAlgo) (manifest []ManifestEntry, err error) {
+	if _, err = algo.newHash(); err != nil {
+		return nil, err
+	}
+	if algo == HashNone {
+		return nil, errors.New("a manifest needs a hash")
+	}
+	metadata, err := extractor.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	manifest = make([]ManifestEntry, 0, len(metadata.Blocks))
+	for _, block := range metadata.Blocks {
+		entry := ManifestEntry{Name: block.Name, StoredSize: block.ZippedSize, HashAlgo: algo}
+		reader, err := extractor.GetReader(block.Name)
+		if err != nil {
+			return nil, err
+		}
+		hasher, _ := algo.newHash()
+		entry.Size, err = io.Copy(hasher, reader)
+		_ = reader.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Reading %s", block.Name)
+		}
+		entry.Hash = hexSum(hasher)
+		entry.Ratio = compressionRatio(entry.StoredSize, entry.Size)
+		if algo == HashSHA256 {
+			entry.SHA256 = entry.Hash
+		}
+		manifest = append(manifest, entry)
+	}
+	return manifest, nil
+}
+
+// Procedure:
+//  *BinAppendExtractor.Verify
+// Purpose:
+//  To check a block against the checksum recorded when it was packed
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name of the block: dataName string
+// Produces:
+//  Why the block doesn't match, if it doesn't: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  The block is read in full, and hashed with the algorithm recorded
+//    with it, whatever the appender that packed it defaulted to
+//  err is ErrNoChecksum if the block was packed without one
+//  On a mismatch, err gives both checksums
+func (extractor *BinAppendExtractor) Verify(dataName string) error {
+	reader, data, err := extractor.openBlock(dataName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+	if data.Checksum == "" {
+		return ErrNoChecksum
+	}
+	hasher, err := data.HashAlgo.newHash()
+	if err != nil {
+		return errors.Wrapf(err, "Verifying %s", dataName)
+	}
+	if hasher == nil {
+		return ErrNoChecksum
+	}
+	reader.dataReader, err = extractor.decompressor(data, reader.dataReader)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(hasher, reader); err != nil {
+		return errors.Wrapf(err, "Reading %s", dataName)
+	}
+	return checkSum(dataName, data, hasher)
+}
+
+//Returns an error unless hasher, having read the block dataName,
+//matches its recorded checksum
+func checkSum(dataName string, data appendedData, hasher hash.Hash) error {
+	if actual := hexSum(hasher); actual != data.Checksum {
+		return errors.Errorf("%s does not match its checksum: expected %s %s, got %s", dataName, data.HashAlgo, data.Checksum, actual)
+	}
+	return nil
+}
+
+// Procedure:
+//  *BinAppendExtractor.GetVerifiedReader
+// Purpose:
+//  To stream a block while checking it against its checksum, without
+//    a separate pass like Verify
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+//  The name of the block: dataName string
+// Produces:
+//  A reader for the block: reader io.ReadCloser
+//  Errors produced: err error
+// Preconditions:
+//  As for GetReader
+// Postconditions:
+//  As for GetReader, but err is ErrNoChecksum if the block was packed
+//    without one
+//  The bytes read are hashed as they go by. If they don't match, the
+//    Read that reaches the end returns the mismatch instead of io.EOF,
+//    and Close returns it too.
+//  Closing before the end reads the rest of the block to finish the
+//    check, so Close returning nil always means the block was intact
+func (extractor *BinAppendExtractor) GetVerifiedReader(dataName string) (reader io.ReadCloser, err error) {
+	blockReader, data, err := extractor.openBlock(dataName)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (io.ReadCloser, error) {
+		_ = blockReader.Close()
+		return nil, err
+	}
+	if data.Checksum == "" {
+		return fail(ErrNoChecksum)
+	}
+	hasher, err := data.HashAlgo.newHash()
+	if err != nil {
+		return fail(errors.Wrapf(err, "Verifying %s", dataName))
+	}
+	if hasher == nil {
+		return fail(ErrNoChecksum)
+	}
+	blockReader.dataReader, err = extractor.decompressor(data, blockReader.dataReader)
+	if err != nil {
+		return fail(err)
+	}
+	return &verifiedReader{reader: blockReader, data: data, hasher: hasher}, nil
+}
+
+//Reader for GetVerifiedReader, hashing what it reads and checking
+//the sum once it reaches the end
+type verifiedReader struct {
+	reader *BinAppendReader
+	data   appendedData
+	hasher hash.Hash
+	//Whether the end has been reached and checked
+	checked bool
+	//The result of the check
+	checkErr error
+}
+
+func (reader *verifiedReader) Read(p []byte) (int, error) {
+	if reader.checked {
+		if reader.checkErr != nil {
+			return 0, reader.checkErr
+		}
+		return 0, io.EOF
+	}
+	n, err := reader.reader.Read(p)
+	_, _ = reader.hasher.Write(p[:n])
+	if err == io.EOF {
+		reader.checked = true
+		reader.checkErr = checkSum(reader.reader.Name, reader.data, reader.hasher)
+		if reader.checkErr != nil {
+			err = reader.checkErr
+		}
+	}
+	return n, err
+}
+
+func (reader *verifiedReader) Close() error {
+	var err error
+	if !reader.checked {
+		_, err = io.Copy(ioutil.Discard, reader)
+		if err == nil {
+			err = reader.checkErr
+		}
+	} else {
+		err = reader.checkErr
+	}
+	closeErr := reader.reader.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Procedure:
+//  *BinAppendExtractor.CheckLength
+// Purpose:
+//  To catch files that were cut short or had bytes injected
+// Parameters:
+//  The parent *BinAppendExtractor: extractor
+// Produces:
+//  How the file's length disagrees with its index, if it does: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  BinAppender writes the index straight after the last block, so err
+//    is non-nil if the furthest block ends anywhere but where the
+//    index starts. With a sidecar index, the file must end right
+//    after the furthest block instead.
+//  Only the index is read
+//  Bytes before the first block, i.e. the binary itself, aren't
+//    checked, and neither is a file with no blocks
+func (extractor *BinAppendExtractor) CheckLength() error {
+	metadata, err := extractor.allMetadata()
+	if err != nil {
+		return err
+	}
+	if len(metadata.Data) == 0 {
+		return nil
+	}
+	var blocksEnd int64
+	for _, data := range metadata.Data {
+		if end := data.StartFilePtr + data.ZippedSize; end > blocksEnd {
+			blocksEnd = end
+		}
+	}
+	dataEnd := extractor.indexPtr
+	if extractor.source == nil && extractor.indexFilename != extractor.filename {
+		info, err := os.Stat(extractor.filename)
+		if err != nil {
+			return errors.Wrap(err, "Stat blocks file")
+		}
+		dataEnd = info.Size()
+	}
+	if blocksEnd > dataEnd {
+		return errors.Errorf("File is truncated: blocks run to byte %d, but the data ends at %d", blocksEnd, dataEnd)
+	}
+	if blocksEnd < dataEnd {
+		return errors.Errorf("File has %d unexpected bytes between the last block, ending at %d, and the index", dataEnd-blocksEnd, blocksEnd)
+	}
+	return nil
+}
+
+//Reads every entry in the extractor's index
+func (extractor *BinAppendExtractor) allMetadata() (appendedMetadata, error) {
+	var indexHandle io.ReaderAt = extractor.source
+	if indexHandle == nil {
+		indexFile, err := os.Open(extractor.indexFilename)
+		if err != nil {
+			return appendedMetadata{}, errors.Wrap(err, "opening index filehandle")
+		}
+		defer func() { _ = indexFile.Close() }()
+		indexHandle = indexFile
+	}
+	metadata, err := readAllMetadata(extractor.index, indexHandle)
+	if err != nil {
+		return metadata, errors.Wrap(err, "reading index")
+	}
+	return metadata, nil
+}
+
 // Type:
 //  BinAppendReader
 // Purpose:
@@ -203,10 +1442,15 @@ type BinAppendReader struct {
 	//The name of the data as inputed by the BinAppender
 	Name string
 
-	// gzReader wraps the limitReader which wraps the underlying fileHandle
+	// dataReader wraps the section reader over the underlying file or mmap,
+	// buffered unless the extractor's ReadBufferSize is negative
+	// It undoes the block's framing unless the block was stored uncompressed
 
+	//nil if the extractor reads from an io.ReaderAt it was given
 	fileHandle *os.File
-	gzReader *gzip.Reader
+	dataReader io.Reader
+	//Set if the block is being read through mmap
+	unmap func() error
 }
 
 // Procedure:
@@ -224,7 +1468,7 @@ type BinAppendReader struct {
 // Postconditions:
 //  See the documentation for io.Reader
 func (reader *BinAppendReader) Read(p []byte) (n int, err error) {
-	return reader.gzReader.Read(p)
+	return reader.dataReader.Read(p)
 }
 
 // Procedure:
@@ -241,5 +1485,16 @@ func (reader *BinAppendReader) Read(p []byte) (n int, err error) {
 // Postconditions:
 //  All resources for the BinAppendReader have been closed
 func (reader *BinAppendReader) Close() error {
-	return reader.fileHandle.Close()
+	var err error
+	if reader.unmap != nil {
+		err = reader.unmap()
+		reader.unmap = nil
+	}
+	if reader.fileHandle != nil {
+		closeErr := reader.fileHandle.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
@@ -0,0 +1,596 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"os"
+	"io"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math/rand"
+	"io/ioutil"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Writes a fake binary to pack into, returning its path
+func testBinary(t testing.TB) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "binary")
+	if err := ioutil.WriteFile(path, []byte("not really a binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//Reads the whole block name out of filename
+func readTestBlock(t *testing.T, filename string, name string) string {
+	t.Helper()
+	extractor, err := MakeAppendExtractor(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := extractor.ByteArray(name)
+	if err != nil {
+		t.Fatalf("reading %s: %s", name, err)
+	}
+	return string(data)
+}
+
+func TestAttributesAreCopies(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := map[string]string{"lang": "en"}
+	err = appender.AppendStreamReaderWithAttrs("subs", strings.NewReader("hello"), attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The appender keeps its own copy too
+	attrs["lang"] = "changed before close"
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	extractor, err := MakeAppendExtractor(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		attrs func() (map[string]string, error)
+	}{
+		{"Attributes", func() (map[string]string, error) {
+			return extractor.Attributes("subs")
+		}},
+		{"Metadata", func() (map[string]string, error) {
+			metadata, err := extractor.Metadata()
+			if err != nil {
+				return nil, err
+			}
+			return metadata.Blocks[0].Attributes, nil
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.attrs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got["lang"] != "en" {
+				t.Fatalf("lang is %q, expected en", got["lang"])
+			}
+			got["lang"] = "changed by the caller"
+			again, err := test.attrs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again["lang"] != "en" {
+				t.Errorf("changing the result changed the index: lang is now %q", again["lang"])
+			}
+		})
+	}
+}
+
+func TestVerifyRoundTripsEveryHashAlgo(t *testing.T) {
+	tests := []struct {
+		algo HashAlgo
+		//Hex sum of an empty block, "" for none
+		empty string
+	}{
+		{HashCRC32, "00000000"},
+		{HashSHA256, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{HashBLAKE3, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{HashNone, ""},
+	}
+	for _, test := range tests {
+		t.Run(string(test.algo), func(t *testing.T) {
+			binary := testBinary(t)
+			appender, err := MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appender.HashAlgo = test.algo
+			//Stored as is, so the corruption below reaches the hash
+			appender.FastPack = true
+			if err = appender.AppendStreamReader("block", strings.NewReader("some block data")); err != nil {
+				t.Fatal(err)
+			}
+			hash, err := appender.AppendStreamReaderHashed("empty", strings.NewReader(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%x", hash) != test.empty {
+				t.Errorf("empty block hashed to %x; expected %s", hash, test.empty)
+			}
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			extractor, err := MakeAppendExtractor(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = extractor.Verify("block")
+			if test.algo == HashNone {
+				if err != ErrNoChecksum {
+					t.Errorf("expected ErrNoChecksum, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//Flip a byte of the block and it shouldn't verify
+			contents, err := ioutil.ReadFile(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := bytes.Index(contents, []byte("some block data"))
+			if start < 0 {
+				t.Fatal("block wasn't stored as is")
+			}
+			contents[start] ^= 0xff
+			if err = ioutil.WriteFile(binary, contents, 0755); err != nil {
+				t.Fatal(err)
+			}
+			extractor, err = MakeAppendExtractor(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = extractor.Verify("block"); err == nil || !strings.Contains(err.Error(), string(test.algo)) {
+				t.Errorf("expected a %s mismatch, got %v", test.algo, err)
+			}
+		})
+	}
+}
+
+func TestMmapOfTruncatedFileFails(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Random, so the block is big, and not seekable, so it stays gzipped
+	//and reading it short is an error
+	random := make([]byte, 1 << 20)
+	rand.New(rand.NewSource(1)).Read(random)
+	if err = appender.AppendStreamReader("big", io.MultiReader(bytes.NewReader(random))); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	extractor, err := MakeAppendExtractor(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractor.UseMmap = true
+	metadata, err := extractor.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The index is already read, so cut the block in half under it
+	block := metadata.Blocks[0]
+	if block.Stored {
+		t.Fatal("expected the block to be gzipped")
+	}
+	if err = os.Truncate(binary, block.StartFilePtr + block.ZippedSize/2); err != nil {
+		t.Fatal(err)
+	}
+	//Mapping the whole block would SIGBUS here
+	_, err = extractor.ByteArray("big")
+	if err == nil {
+		t.Fatal("reading a block past the end of the file should fail")
+	}
+}
+
+//Hands back at most one byte per ReadAt, without an error, as
+//some sources do even though io.ReaderAt asks them not to
+type oneByteReaderAt struct {
+	source io.ReaderAt
+}
+
+func (reader oneByteReaderAt) ReadAt(output []byte, offset int64) (int, error) {
+	if len(output) == 0 {
+		return 0, nil
+	}
+	return reader.source.ReadAt(output[:1], offset)
+}
+
+func TestIndexReadsSurviveShortReads(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(appender *BinAppender)
+	}{
+		{"json index", func(appender *BinAppender) {}},
+		{"binary index", func(appender *BinAppender) { appender.BinaryIndex = true }},
+		{"gzipped index", func(appender *BinAppender) { appender.CompressIndex = true }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := testBinary(t)
+			appender, err := MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.configure(appender)
+			blocks := map[string]string{"first": "alpha", "second": strings.Repeat("bravo", 100)}
+			for name, content := range blocks {
+				if err = appender.AppendStreamReader(name, strings.NewReader(content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := oneByteReaderAt{bytes.NewReader(data)}
+			extractor, err := MakeAppendExtractorFromReaderAt(source, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range blocks {
+				block, err := extractor.ByteArray(name)
+				if err != nil || string(block) != content {
+					t.Errorf("%s is %q, %v; expected %q", name, block, err, content)
+				}
+			}
+		})
+	}
+}
+
+//Packs count small blocks, returning the file and the block names
+func packSmallBlocks(b *testing.B, count int) (string, []string) {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "binary")
+	if err := ioutil.WriteFile(path, []byte("not really a binary"), 0755); err != nil {
+		b.Fatal(err)
+	}
+	appender, err := MakeAppender(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	names := make([]string, count)
+	for ii := range names {
+		names[ii] = fmt.Sprintf("block-%d", ii)
+		err = appender.AppendStreamReader(names[ii], strings.NewReader(strings.Repeat(names[ii], 50)))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = appender.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return path, names
+}
+
+func BenchmarkReadSmallBlocks(b *testing.B) {
+	path, names := packSmallBlocks(b, 200)
+	benchmarks := []struct {
+		name    string
+		useMmap bool
+	}{
+		{"read", false},
+		{"mmap", true},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			extractor, err := MakeAppendExtractor(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			extractor.UseMmap = benchmark.useMmap
+			b.ResetTimer()
+			for ii := 0; ii < b.N; ii++ {
+				for _, name := range names {
+					if _, err = extractor.ByteArray(name); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSmallReadsOfLargeBlock(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "binary")
+	if err := ioutil.WriteFile(path, []byte("not really a binary"), 0755); err != nil {
+		b.Fatal(err)
+	}
+	appender, err := MakeAppender(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	appender.FastPack = true
+	if err = appender.AppendStreamReader("large", strings.NewReader(strings.Repeat("x", 8 << 20))); err != nil {
+		b.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		b.Fatal(err)
+	}
+	benchmarks := []struct {
+		name       string
+		useMmap    bool
+		bufferSize int
+	}{
+		//Unbuffered, so each small read is a read of the file
+		{"read", false, -1},
+		{"buffered read", false, 0},
+		{"mmap", true, -1},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			extractor, err := MakeAppendExtractor(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			extractor.UseMmap = benchmark.useMmap
+			extractor.ReadBufferSize = benchmark.bufferSize
+			chunk := make([]byte, 512)
+			b.ResetTimer()
+			for ii := 0; ii < b.N; ii++ {
+				reader, err := extractor.GetReader("large")
+				if err != nil {
+					b.Fatal(err)
+				}
+				for err == nil {
+					_, err = reader.Read(chunk)
+				}
+				_ = reader.Close()
+			}
+		})
+	}
+}
+
+func TestReadingBlocksPastFourGigabytes(t *testing.T) {
+	tests := []struct {
+		name        string
+		binaryIndex bool
+		useMmap     bool
+	}{
+		{"json index", false, false},
+		{"binary index", true, false},
+		{"json index with mmap", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := testBinary(t)
+			//Sparse, so this takes no real space, but pushes every block past
+			//where a 32-bit int could hold its offset
+			if err := os.Truncate(binary, 5 << 30); err != nil {
+				t.Skip("can't make a large sparse file here:", err)
+			}
+			appender, err := MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appender.BinaryIndex = test.binaryIndex
+			if err = appender.AppendStreamReader("far", strings.NewReader("away")); err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			extractor, err := MakeStrictAppendExtractor(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extractor.UseMmap = test.useMmap
+			data, err := extractor.ByteArray("far")
+			if err != nil || string(data) != "away" {
+				t.Errorf("far is %q, %v; expected \"away\"", data, err)
+			}
+		})
+	}
+}
+
+func TestHugeIndexPointersAreRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		pointer uint64
+	}{
+		//Negative once cast to an int64
+		{"top bit set", 1 << 63},
+		{"all bits set", ^uint64(0)},
+		{"past the end of the file", 1 << 40},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var data bytes.Buffer
+			data.WriteString("not really a binary")
+			pointerBytes := make([]byte, indexPtrSize)
+			binary.LittleEndian.PutUint64(pointerBytes, test.pointer)
+			data.Write(pointerBytes)
+			_, err := MakeAppendExtractorFromReaderAt(bytes.NewReader(data.Bytes()), int64(data.Len()))
+			if err == nil {
+				t.Errorf("index pointer %#x should not be accepted", test.pointer)
+			}
+		})
+	}
+}
+
+func TestCopyBlockTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "region")
+	if err := ioutil.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		path  string
+		start int64
+		size  int64
+		want  string
+		fails bool
+	}{
+		{"whole file", path, 0, 10, "0123456789", false},
+		{"middle", path, 3, 4, "3456", false},
+		{"empty", path, 5, 0, "", false},
+		{"past the end", path, 8, 5, "89", true},
+		{"negative start", path, -1, 2, "", true},
+		{"negative size", path, 0, -2, "", true},
+		{"missing file", path + ".missing", 0, 1, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var output bytes.Buffer
+			n, err := CopyBlockTo(&output, test.path, test.start, test.size)
+			if (err != nil) != test.fails {
+				t.Errorf("expected failure %v, got %v", test.fails, err)
+			}
+			if output.String() != test.want || n != int64(len(test.want)) {
+				t.Errorf("copied %d bytes, %q; expected %q", n, output.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestCopyBlockToCopiesPackedBlocks(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Long enough that gzip shrinks it, so it isn't stored as is
+	content := strings.Repeat("packed data ", 100)
+	if err = appender.AppendStreamReader("block", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	extractor, err := MakeAppendExtractor(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := extractor.Metadata()
+	if err != nil || len(metadata.Blocks) != 1 {
+		t.Fatalf("expected one block, got %v, %v", metadata, err)
+	}
+	block := metadata.Blocks[0]
+	if block.Stored {
+		t.Fatal("expected the block to be gzipped")
+	}
+
+	var compressed bytes.Buffer
+	if _, err = CopyBlockTo(&compressed, binary, block.StartFilePtr, block.ZippedSize); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil || string(data) != content {
+		t.Errorf("block is %q, %v", data, err)
+	}
+}
+
+func TestReadBufferSizesRoundTrip(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := string(compressibleData(1 << 20))
+	if err = appender.AppendStreamReader("gzipped", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	appender.FastPack = true
+	if err = appender.AppendStreamReader("stored", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		bufferSize int
+	}{
+		{"unbuffered", -1},
+		{"default", 0},
+		{"smaller than a read", 100},
+		{"larger than the block", 4 << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extractor, err := MakeAppendExtractor(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extractor.ReadBufferSize = test.bufferSize
+			for _, name := range []string{"gzipped", "stored"} {
+				reader, err := extractor.GetReader(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				//Small reads, like a client parsing a config line by line
+				var output bytes.Buffer
+				chunk := make([]byte, 512)
+				for err == nil {
+					var n int
+					n, err = reader.Read(chunk)
+					output.Write(chunk[:n])
+				}
+				_ = reader.Close()
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+				if output.String() != data {
+					t.Errorf("%s read back as %d bytes that don't match the %d packed", name, output.Len(), len(data))
+				}
+			}
+		})
+	}
+}
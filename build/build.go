@@ -24,13 +24,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"fmt"
+	"errors"
 	"net"
 	"time"
 	"encoding/base64"
 	"crypto/x509"
 	"crypto/rsa"
 	"io/ioutil"
+	"io"
+	"bytes"
+	"regexp"
+	"context"
 
 	cert "github.com/yourfin/transcodebot/certificate"
 	"github.com/yourfin/transcodebot/common"
@@ -43,6 +49,10 @@ type BuildSettings struct {
 	//Default is transcode-client
 	OutputPrefix string
 
+	//Directory to put the built clients and their certificate index in
+	//Default ("") is the clients directory in the settings dir
+	OutputDir string
+
 	//Whether or not to compress the files
 	//if this variable is true, then the output binaries will not be zipped
 	//Default false
@@ -50,100 +60,838 @@ type BuildSettings struct {
 
 	//Force a new server certificate to be generated
 	//Invalidates all previous clients
+	//One is generated anyway if none exists yet
 	ForceNewCert bool
 
 	//Valid IP's for the main server
 	ServerIPs []net.IP
 
+	//Valid hostnames for the main server
+	//At least one of ServerIPs and ServerHosts is needed to generate a certificate
+	ServerHosts []string
+
+	//Subject of the root certificate, when one is generated, and of
+	//every client certificate
+	//Default is just the organization transcodebot-<hostname>
+	CertSubject cert.Subject
+
 	//List of system os/arch combinations to target
 	Targets []common.SystemType
+
+	//Directory holding the client's source, which go build is run in
+	//Default is $GOPATH/src/github.com/yourfin/transcodebot/client
+	ClientSourceDir string
+
+	//Import path of the client package, e.g. github.com/yourfin/transcodebot/client
+	//If set, it is passed to go build, which is run in the current
+	//directory, and ClientSourceDir is ignored. This is the way to
+	//build from a module.
+	//Default ""
+	ClientImportPath string
+
+	//GOFLAGS and GOPROXY for go build, e.g. -mod=vendor to build offline
+	//from a vendored tree, or the URL of an internal module proxy
+	//Default ("") leaves whatever is in the environment
+	GoFlags string
+	GoProxy string
+
+	//Extra environment variables for go build on every target, in
+	//KEY=value form, e.g. GONOSUMDB=example.com/internal
+	//These override the inherited environment, the defaults below,
+	//GoFlags, and GoProxy, and are overridden by TargetEnv
+	Env []string
+
+	//Build from the client module's vendor directory with -mod=vendor,
+	//failing if the module has none. Without this, -mod=vendor is
+	//still passed whenever the module has a vendor directory, unless
+	//GoFlags sets -mod itself. Only applies in module mode, i.e. when
+	//a go.mod is found at or above where go build runs; in GOPATH
+	//mode go build uses vendor directories on its own and rejects -mod.
+	//Default false
+	Vendor bool
+
+	//Extra environment variables for go build, by target, in KEY=value form
+	//These are added after the defaults (CGO_ENABLED=0, or 1 for a race or
+	//msan BuildMode, GOARCH, GOOS), so they override them, e.g.
+	//CGO_ENABLED=1 along with a CC for the target
+	TargetEnv map[common.SystemType][]string
+
+	//Optional channel to report the progress of each target on
+	//If nil, no events are sent
+	Events chan<- BuildEvent
+
+	//Where messages about the build go
+	//Default (nil) prints them with the common package
+	Logger Logger
+
+	//Number of times to rerun a failed go build for a target, for
+	//transient failures like fetching modules. Failures that are
+	//clearly errors in the source are not retried
+	//Default 0
+	Retries int
+
+	//Also build darwin/amd64 and darwin/arm64, adding them to Targets
+	//if needed, and combine them with lipo into one universal binary
+	//named OutputPrefix + darwin-universal. Needs lipo on the PATH.
+	//Default false
+	MacUniversal bool
+
+	//Run each binary built for this machine's OS and arch with
+	//--selftest, failing the target unless it exits 0, to catch
+	//binaries that build but crash on startup. Other targets can't
+	//be run here and are skipped.
+	//Default false
+	SmokeTest bool
+
+	//How go build instruments or links the clients: race or msan for
+	//the -race or -msan detectors, or a -buildmode such as pie.
+	//The detectors need cgo, so they turn CGO_ENABLED on and only work
+	//for this machine's target, if the go toolchain has a detector for
+	//it at all. Build fails up front when asked for anything else.
+	//Default "" is a normal build
+	BuildMode string
+
+	//Before compiling, remove files in the build dir that start with
+	//OutputPrefix but aren't built for any current target, e.g.
+	//binaries for targets that have since been dropped. The client
+	//certificate index is always kept.
+	//Default false
+	Clean bool
+
+	//Do all of the setup and print the go build command for each
+	//target instead of running it. No certificates are generated.
+	//Default false
+	DryRun bool
 }
 const build_extention = "clients"
 
+//Stage of the build a BuildEvent reports on
+type BuildPhase int
+
+const (
+	//The target has been picked up
+	PhaseStart BuildPhase = iota
+	//The client certificate for the target is being generated
+	PhaseCertGen
+	//go build is running for the target
+	PhaseCompile
+	//The target finished successfully
+	PhaseDone
+	//The target failed, see BuildEvent.Err
+	PhaseError
+)
+
+func (phase BuildPhase) ToString() string {
+	switch phase {
+	case PhaseStart:
+		return "start"
+	case PhaseCertGen:
+		return "certgen"
+	case PhaseCompile:
+		return "compile"
+	case PhaseDone:
+		return "done"
+	case PhaseError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+//Progress report for a single target of a build
+type BuildEvent struct {
+	Target common.SystemType
+	Phase  BuildPhase
+	//Only set when Phase is PhaseError
+	Err error
+}
+
+//Sends an event on settings.Events if it is set
+func (settings BuildSettings) sendEvent(target common.SystemType, phase BuildPhase, err error) {
+	if settings.Events != nil {
+		settings.Events <- BuildEvent{Target: target, Phase: phase, Err: err}
+	}
+}
+
+//How a single target of a build went
+type TargetResult struct {
+	Target common.SystemType
+	//Path of the built binary
+	Binary string
+	//Time spent in go build, summed over any retries
+	CompileTime time.Duration
+	//Why the target failed, nil if it was built
+	Err error
+}
+
+//How a whole build went
+type BuildResults struct {
+	//In the same order as BuildSettings.Targets
+	Targets []TargetResult
+	//Wall clock time of the whole build
+	Total time.Duration
+	//Path of the universal macOS binary, if BuildSettings.MacUniversal
+	Universal string
+}
+
 //Builds client binaries according to the passed in settings
 func Build(settings BuildSettings) error {
-	buildDir := common.SettingsDir(build_extention)
+	_, err := BuildWithResults(settings)
+	return err
+}
+
+// Procedure:
+//  BuildWithResults
+// Purpose:
+//  To build client binaries, reporting how each target went
+// Parameters:
+//  What to build: settings BuildSettings
+// Produces:
+//  Per target outcomes and timings: results BuildResults
+//  The first problem with the build as a whole: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  As for Build
+//  results.Targets is only filled in once compiling starts, so it
+//    is empty for dry runs and setup errors
+//  Each target's compile time is logged verbosely
+func BuildWithResults(settings BuildSettings) (results BuildResults, err error) {
+	started := time.Now()
+	defer func() { results.Total = time.Since(started) }()
 
-	if settings.ForceNewCert { //or no cert exists
-		cert.GenRootCert(settings.ServerIPs)
+	buildDir := settings.outputDir()
+	if len(settings.Targets) == 0 {
+		return results, errors.New("no targets to build")
+	}
+	if err = ValidateBuildMode(settings.BuildMode); err != nil {
+		return results, err
+	}
+	var lipoPath string
+	if settings.MacUniversal {
+		lipoPath, err = exec.LookPath("lipo")
+		if err != nil {
+			return results, fmt.Errorf("lipo is needed to build a universal macOS binary: %s", err)
+		}
+		settings.Targets = withMacSlices(settings.Targets)
+	}
+	if err = ValidateDetectorTargets(settings.BuildMode, settings.Targets); err != nil {
+		return results, err
 	}
-	rootCert := cert.ReadCert("root")
-	rootCertPEM, _ := ioutil.ReadFile(buildDir + string(os.PathSeparator) + "root.crt")
-	rootKey := cert.ReadRsaKey("root")
 
-	//get the dir we were called from so we can come back
-	calledPath, err := os.Getwd()
-	if err != nil {
-		common.PrintError("getting working directory err: ", err)
+	//Every build needs the root certificate and key to sign client certificates
+	rootMissing := false
+	for _, certFile := range []string{"root.crt", "root.keyfile"} {
+		if _, err := os.Stat(common.SettingsDir("cert", certFile)); os.IsNotExist(err) {
+			rootMissing = true
+		}
 	}
-	calledPath, err = filepath.Abs(calledPath)
-	if err != nil {
-		common.PrintError("absolute path err: ", err)
+	if settings.ForceNewCert || rootMissing {
+		if len(settings.ServerIPs) == 0 && len(settings.ServerHosts) == 0 {
+			if !settings.ForceNewCert {
+				return results, fmt.Errorf("root certificate missing from %s; run with --force-new-certificate or give a server IP or hostname to let it auto-generate", common.SettingsDir("cert"))
+			}
+			return results, errors.New("a server IP or hostname is needed to generate a certificate clients can verify")
+		}
+		if rootMissing {
+			settings.logger().Infof("No root certificate found, generating one")
+		}
+		if settings.DryRun {
+			settings.logger().Infof("Would generate a new root certificate for %v %v", settings.ServerIPs, settings.ServerHosts)
+		} else {
+			cert.GenRootCert(settings.ServerIPs, settings.ServerHosts, settings.CertSubject)
+		}
 	}
 
-	//go back to the original working directory after the build
-	defer func() {
-		err = os.Chdir(calledPath)
+	var (
+		rootCert *x509.Certificate
+		rootCertPEM []byte
+		rootKey *rsa.PrivateKey
+	)
+	if settings.DryRun {
+		for _, certFile := range []string{"root.crt", "root.keyfile"} {
+			certPath := common.SettingsDir("cert", certFile)
+			if _, err := os.Stat(certPath); err != nil {
+				settings.logger().Infof("Certificate file %s is missing: %s", certPath, err)
+			} else {
+				settings.logger().Infof("Certificate file %s found", certPath)
+			}
+		}
+	} else {
+		//Embedded as is in every client, so an empty one would give
+		//clients that can't verify the server
+		rootCertPath := common.SettingsDir("cert", "root.crt")
+		var err error
+		rootCertPEM, err = ioutil.ReadFile(rootCertPath)
 		if err != nil {
-			panic(fmt.Sprintf("change back to original working dir err: %s", err))
+			return results, fmt.Errorf("reading root certificate %s err: %s", rootCertPath, err)
 		}
-	}()
+		if len(bytes.TrimSpace(rootCertPEM)) == 0 {
+			return results, fmt.Errorf("root certificate %s is empty", rootCertPath)
+		}
+		rootCert = cert.ReadCert("root")
+		rootKey = cert.ReadRsaKey("root")
+	}
 
-	err = os.Chdir(filepath.Join(
-		os.Getenv("GOPATH"),
-		"src",
-		"github.com",
-		"yourfin",
-		"transcodebot",
-		"client"))
-	if err != nil {
-		common.PrintError("Moving to build dir err: ", err, "\nAre you sure your GOPATH environment variable is set?")
+	clientDir := settings.clientSourceDir()
+	if settings.DryRun {
+		if settings.ClientImportPath != "" {
+			clientDir = "the current directory"
+		} else if _, err := os.Stat(clientDir); err != nil {
+			settings.logger().Infof("Client source dir %s is missing: %s", clientDir, err)
+		}
+		if settings.Vendor && settings.vendorModuleRoot() == "" {
+			settings.logger().Infof("No module with a vendor directory at or above %s to build from", settings.goBuildDir())
+		}
+		if settings.Clean {
+			stale, err := settings.staleArtifacts(buildDir)
+			if err != nil {
+				return results, fmt.Errorf("listing stale artifacts err: %s", err)
+			}
+			for _, path := range stale {
+				settings.logger().Infof("Would remove %s", path)
+			}
+		}
+		settings.logger().Infof("Would run in %s:", clientDir)
+		for _, target := range settings.Targets {
+			ldflagsString := ldflagsFor("<client key>", "<client cert>", "<server cert>")
+			command := settings.buildCommand(buildDir, target, ldflagsString)
+			settings.logger().Infof("  %s %s", strings.Join(settings.buildEnv(target), " "), strings.Join(command.Args, " "))
+		}
+		if settings.MacUniversal {
+			settings.logger().Infof("  %s", strings.Join(settings.lipoCommand(lipoPath, buildDir).Args, " "))
+		}
+		return results, nil
+	}
+
+	if settings.Vendor && settings.vendorModuleRoot() == "" {
+		return results, fmt.Errorf("vendoring was asked for, but there is no module with a vendor directory at or above %s", settings.goBuildDir())
+	}
+
+	//go build finds the client by its import path on its own
+	if settings.ClientImportPath == "" {
+		info, err := os.Stat(clientDir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", clientDir)
+		}
+		if err != nil {
+			return results, fmt.Errorf("client source dir err: %s\nAre you sure your GOPATH environment variable is set?", err)
+		}
 	}
 
 	common.CowardlyCreateDir(buildDir)
+	if settings.Clean {
+		stale, err := settings.staleArtifacts(buildDir)
+		if err != nil {
+			return results, fmt.Errorf("listing stale artifacts err: %s", err)
+		}
+		for _, path := range stale {
+			if err = os.Remove(path); err != nil {
+				return results, fmt.Errorf("removing stale artifact err: %s", err)
+			}
+			settings.logger().Infof("Removed %s", path)
+		}
+	}
 
 	//Compile
-	common.Println("Building...")
-	doneChan := make(chan int)
+	settings.logger().Infof("Building...")
+	//Index of each finished target, and how it went
+	type compileResult struct {
+		index int
+		result TargetResult
+		//Everything logged while building the target
+		log *bufferedLogger
+	}
+	doneChan := make(chan compileResult)
+	certRecords := make([]ClientCertRecord, len(settings.Targets))
 	for ii, target := range settings.Targets {
+		settings.sendEvent(target, PhaseStart, nil)
+
 		//Generate new client certificate
-		ldflagsString := handleBuildCerts(rootKey, rootCert, rootCertPEM, target)
-
-		builtName := filepath.Join(buildDir, settings.OutputPrefix + target.ToString())
-		if target.OS == common.Windows {
-			builtName = builtName + ".exe"
-		}
-		command := exec.Command("go", "build", "-a", "-ldflags", ldflagsString, "-o", builtName)
-		//Duplicate entries are removed automatically on execution
-		command.Env = append(
-			os.Environ(),
-			"CGO=0",
-			"GOARCH=" + target.Arch.ToString(),
-			"GOOS=" + target.OS.ToString(),
-		)
-		common.Println(ldflagsString)
+		settings.sendEvent(target, PhaseCertGen, nil)
+		ldflagsString, certRecord := handleBuildCerts(rootKey, rootCert, rootCertPEM, target, settings.CertSubject)
+		certRecord.Binary = filepath.Base(settings.builtName(buildDir, target))
+		certRecords[ii] = certRecord
+
+		//The Logger may send this anywhere, so leave out the private key
+		settings.logger().Infof("%s", ldflagsFor("<client key>", "<client cert " + certRecord.Serial + ">", "<server cert>"))
 		//Note that range variables are shared between
 		//loops but others are not, hence the passing by
 		//value
-		go func(index int, target common.SystemType) {
-			//go build doesn't use stdout
-			stderr, err := command.CombinedOutput()
-			if len(stderr) != 0 {
-				common.PrintError("Compile error building", target.ToString(), ":", string(stderr[:]))
-			} else if err != nil {
-				common.PrintError("Compile error building", target.ToString(), ":", err)
+		go func(index int, target common.SystemType, ldflagsString string) {
+			//Only the loop reading doneChan prints, so that targets
+			//finishing at once don't interleave their output
+			log := &bufferedLogger{}
+			settings := settings
+			settings.Logger = log
+			settings.sendEvent(target, PhaseCompile, nil)
+			compileTime, err := settings.compile(buildDir, target, ldflagsString)
+			log.Verbosef("%s: %s", target.ToString(), compileTime.Round(time.Second))
+			if err == nil {
+				if err = packServerCert(settings.builtName(buildDir, target), rootCertPEM); err != nil {
+					log.Errorf("Packing server certificate into %s: %s", target.ToString(), err)
+				} else if err = settings.smokeTest(settings.builtName(buildDir, target), target); err != nil {
+					log.Errorf("Smoke test of %s failed: %s", target.ToString(), err)
+				}
+			} else {
+				log.Errorf("Compile error building %s: %s", target.ToString(), err)
 			}
-			doneChan <- index
-		}(ii, target)
+			if err != nil {
+				settings.sendEvent(target, PhaseError, err)
+			} else {
+				settings.sendEvent(target, PhaseDone, nil)
+			}
+			doneChan <- compileResult{index: index, result: TargetResult{
+				Target:      target,
+				Binary:      settings.builtName(buildDir, target),
+				CompileTime: compileTime,
+				Err:         err,
+			}, log: log}
+		}(ii, target, ldflagsString)
 	}
+	var failed []string
+	var failedLogs []*bufferedLogger
+	var builtRecords []ClientCertRecord
+	results.Targets = make([]TargetResult, len(settings.Targets))
 	for finishedCompiles := 0; finishedCompiles < len(settings.Targets); finishedCompiles++ {
-		doneNumber := <- doneChan
-		common.PrintVerbose(settings.Targets[doneNumber].ToString(), "compile finished")
+		finished := <- doneChan
+		results.Targets[finished.index] = finished.result
+		if finished.result.Err == nil {
+			finished.log.replay(settings.logger())
+			builtRecords = append(builtRecords, certRecords[finished.index])
+		} else {
+			failedLogs = append(failedLogs, finished.log)
+			failed = append(failed, finished.result.Target.ToString())
+		}
+	}
+	//Record the certificates that were actually built into something
+	//before reporting failures, so a Logger that gives up on the first
+	//error can't lose the certificates of binaries that were built
+	err = appendCertIndex(buildDir, builtRecords)
+	for _, log := range failedLogs {
+		log.replay(settings.logger())
+	}
+	if err != nil {
+		return results, fmt.Errorf("recording client certificates err: %s", err)
+	}
+	if len(failed) != 0 {
+		return results, fmt.Errorf("failed to compile %s", strings.Join(failed, ", "))
+	}
+	if settings.MacUniversal {
+		results.Universal = settings.universalName(buildDir)
+		output, err := settings.lipoCommand(lipoPath, buildDir).CombinedOutput()
+		if err != nil {
+			return results, fmt.Errorf("combining macOS binaries err: %s: %s", err, bytes.TrimSpace(output))
+		}
+		//lipo only keeps the Mach-O images, not what was packed after them
+		err = packServerCert(results.Universal, rootCertPEM)
+		if err != nil {
+			return results, fmt.Errorf("packing server certificate into %s err: %s", results.Universal, err)
+		}
+	}
+	settings.logger().Verbosef("All complies finished in %s. Binaries at: %s", time.Since(started).Round(time.Second), buildDir)
+	return results, nil
+}
+
+//Wait before the first retry of a failed go build, doubled for each one after
+const retryBackoff = 2 * time.Second
+
+//go build's format for errors in the source, e.g. ./main.go:12:3: undefined: x
+var sourceErrorPattern = regexp.MustCompile(`(?m)^\S+\.go:\d+(:\d+)?: `)
+
+// Procedure:
+//  BuildSettings.compile
+// Purpose:
+//  To run go build for a single target, retrying if it fails
+// Parameters:
+//  The calling BuildSettings: settings
+//  Where binaries go: buildDir string
+//  What to build for: target common.SystemType
+//  The ldflags to build with: ldflagsString string
+// Produces:
+//  Time spent running go build over every attempt: compileTime time.Duration
+//  Why the last attempt failed: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  go build is run up to settings.Retries + 1 times, with a
+//    growing wait between tries, stopping at the first one that
+//    exits 0, whatever it printed, and leaves a binary that passes
+//    checkExecutable
+//  Output pointing at errors in the source is not retried
+//  Each retry is logged
+func (settings BuildSettings) compile(buildDir string, target common.SystemType, ldflagsString string) (compileTime time.Duration, err error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		started := time.Now()
+		//go build doesn't use stdout
+		output, err := settings.buildCommand(buildDir, target, ldflagsString).CombinedOutput()
+		compileTime += time.Since(started)
+		if err == nil {
+			//Module builds print what they download even when they succeed
+			if len(output) != 0 {
+				settings.logger().Verbosef("%s: %s", target.ToString(), bytes.TrimSpace(output))
+			}
+			err = checkExecutable(settings.builtName(buildDir, target), target)
+			if err == nil {
+				return compileTime, nil
+			}
+			err = fmt.Errorf("bad binary: %s", err)
+		} else if len(output) != 0 {
+			err = errors.New(string(output))
+		}
+		if attempt >= settings.Retries || sourceErrorPattern.Match(output) {
+			return compileTime, err
+		}
+		settings.logger().Infof("Compile of %s failed, retrying in %s (%d/%d): %s",
+			target.ToString(), backoff, attempt+1, settings.Retries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+//The Mac targets combined by MacUniversal
+var macSlices = []common.SystemType{
+	{OS: common.OSx, Arch: common.Amd64},
+	{OS: common.OSx, Arch: common.Arm64},
+}
+
+//targets plus any of macSlices it is missing, without changing targets
+func withMacSlices(targets []common.SystemType) []common.SystemType {
+	output := append([]common.SystemType{}, targets...)
+	for _, slice := range macSlices {
+		present := false
+		for _, target := range targets {
+			present = present || target == slice
+		}
+		if !present {
+			output = append(output, slice)
+		}
+	}
+	return output
+}
+
+//Path of the universal macOS binary
+func (settings BuildSettings) universalName(buildDir string) string {
+	return filepath.Join(buildDir, settings.OutputPrefix + "darwin-universal")
+}
+
+//The lipo command combining macSlices into the universal binary
+func (settings BuildSettings) lipoCommand(lipoPath string, buildDir string) *exec.Cmd {
+	args := []string{"-create", "-output", settings.universalName(buildDir)}
+	for _, slice := range macSlices {
+		args = append(args, settings.builtName(buildDir, slice))
+	}
+	return exec.Command(lipoPath, args...)
+}
+
+//Where the built clients go
+func (settings BuildSettings) outputDir() string {
+	if settings.OutputDir != "" {
+		return settings.OutputDir
+	}
+	return common.SettingsDir(build_extention)
+}
+
+//Where the client is built from when it isn't built by import path
+func (settings BuildSettings) clientSourceDir() string {
+	if settings.ClientSourceDir != "" {
+		return settings.ClientSourceDir
+	}
+	return filepath.Join(
+		os.Getenv("GOPATH"),
+		"src",
+		"github.com",
+		"yourfin",
+		"transcodebot",
+		"client")
+}
+
+//Where go build is run: the current directory when building by
+//import path, otherwise the client source dir
+func (settings BuildSettings) goBuildDir() string {
+	if settings.ClientImportPath != "" {
+		return "."
+	}
+	return settings.clientSourceDir()
+}
+
+//The root of the module go build would build the client in, if it
+//has a vendor directory, otherwise ""
+func (settings BuildSettings) vendorModuleRoot() string {
+	dir, err := filepath.Abs(settings.goBuildDir())
+	if err != nil {
+		return ""
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			info, err := os.Stat(filepath.Join(dir, "vendor"))
+			if err == nil && info.IsDir() {
+				return dir
+			}
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+//Flags for go build to build from the vendor directory, if it should
+func (settings BuildSettings) vendorArgs() []string {
+	//GoFlags picking a -mod wins unless Vendor insists
+	if !settings.Vendor && strings.Contains(settings.GoFlags, "-mod=") {
+		return nil
+	}
+	if settings.vendorModuleRoot() == "" {
+		return nil
+	}
+	return []string{"-mod=vendor"}
+}
+
+//Targets go build supports the -race and -msan detectors for,
+//out of the ones Build knows about
+var (
+	raceTargets = []common.SystemType{
+		{OS: common.Linux, Arch: common.Amd64},
+		{OS: common.Linux, Arch: common.Arm64},
+		{OS: common.OSx, Arch: common.Amd64},
+		{OS: common.OSx, Arch: common.Arm64},
+		{OS: common.Windows, Arch: common.Amd64},
+	}
+	msanTargets = []common.SystemType{
+		{OS: common.Linux, Arch: common.Amd64},
+		{OS: common.Linux, Arch: common.Arm64},
+	}
+)
+
+//The -buildmode values that make sense for a client executable
+var buildmodes = []string{"default", "exe", "pie"}
+
+//Returns an error unless mode can be used as BuildSettings.BuildMode
+func ValidateBuildMode(mode string) error {
+	if mode == "" || mode == "race" || mode == "msan" {
+		return nil
+	}
+	for _, buildmode := range buildmodes {
+		if mode == buildmode {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown build mode %q, expected race, msan, or one of %s", mode, strings.Join(buildmodes, ", "))
+}
+
+// Procedure:
+//  ValidateDetectorTargets
+// Purpose:
+//  To check that the race or msan detector can be built into every target
+// Parameters:
+//  The build mode to check, as for BuildSettings.BuildMode: mode string
+//  The targets to build: targets []common.SystemType
+// Produces:
+//  Why the detector can't be built in, if it can't: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  err is nil for modes other than race and msan
+//  err is non-nil if any target is not this machine's, since the
+//    detectors need cgo, which doesn't cross compile, or if go has no
+//    such detector for this machine
+func ValidateDetectorTargets(mode string, targets []common.SystemType) error {
+	var supported []common.SystemType
+	switch mode {
+	case "race":
+		supported = raceTargets
+	case "msan":
+		supported = msanTargets
+	default:
+		return nil
+	}
+	host := common.HostSystemType()
+	for _, target := range targets {
+		if target != host {
+			return fmt.Errorf("the %s detector needs cgo, so it can only be built for this machine's target %s, not %s", mode, host.ToString(), target.ToString())
+		}
+	}
+	for _, supportedTarget := range supported {
+		if host == supportedTarget {
+			return nil
+		}
+	}
+	return fmt.Errorf("go has no %s detector for this machine's target %s", mode, host.ToString())
+}
+
+//Which of race and msan settings.BuildMode asks for, if target supports
+//it, otherwise ""
+func (settings BuildSettings) detector(target common.SystemType) string {
+	var supported []common.SystemType
+	switch settings.BuildMode {
+	case "race":
+		supported = raceTargets
+	case "msan":
+		supported = msanTargets
+	default:
+		return ""
+	}
+	for _, supportedTarget := range supported {
+		if target == supportedTarget {
+			return settings.BuildMode
+		}
+	}
+	return ""
+}
+
+//Flags for go build that settings.BuildMode adds for target
+func (settings BuildSettings) buildModeArgs(target common.SystemType) []string {
+	switch settings.BuildMode {
+	case "":
+		return nil
+	case "race", "msan":
+		if detector := settings.detector(target); detector != "" {
+			return []string{"-" + detector}
+		}
+		return nil
+	default:
+		return []string{"-buildmode=" + settings.BuildMode}
+	}
+}
+
+//The go build command for target. Dry runs print this same command,
+//so what is printed is what would be run
+func (settings BuildSettings) buildCommand(buildDir string, target common.SystemType, ldflagsString string) *exec.Cmd {
+	args := []string{"build", "-a", "-ldflags", ldflagsString, "-o", settings.builtName(buildDir, target)}
+	args = append(args, settings.buildModeArgs(target)...)
+	args = append(args, settings.vendorArgs()...)
+	if settings.ClientImportPath != "" {
+		args = append(args, settings.ClientImportPath)
+	}
+	command := exec.Command("go", args...)
+	//Scoped to go build rather than chdir-ing the whole process, so
+	//Build is safe to run alongside anything else
+	if settings.ClientImportPath == "" {
+		command.Dir = settings.clientSourceDir()
+	}
+	//Duplicate entries are removed automatically on execution,
+	//keeping the last one, so buildEnv wins over the inherited environment
+	command.Env = append(os.Environ(), settings.buildEnv(target)...)
+	return command
+}
+
+//Environment variables go build is run with for target, on top of the
+//inherited environment. Later entries win, so the order is the defaults,
+//then GoFlags and GoProxy, then Env, then TargetEnv.
+//Note that the go toolchain reads CGO_ENABLED, not CGO.
+func (settings BuildSettings) buildEnv(target common.SystemType) []string {
+	cgo := "CGO_ENABLED=0"
+	if settings.detector(target) != "" {
+		cgo = "CGO_ENABLED=1"
+	}
+	env := []string{
+		cgo,
+		"GOARCH=" + target.Arch.ToString(),
+		"GOOS=" + target.OS.ToString(),
+	}
+	if settings.GoFlags != "" {
+		env = append(env, "GOFLAGS=" + settings.GoFlags)
+	}
+	if settings.GoProxy != "" {
+		env = append(env, "GOPROXY=" + settings.GoProxy)
+	}
+	env = append(env, settings.Env...)
+	return append(env, settings.TargetEnv[target]...)
+}
+
+//How long a smoke tested binary gets to exit
+const smokeTestTimeout = 30 * time.Second
+
+//Runs the binary built for target with --selftest if settings.SmokeTest
+//is set and target is this machine, returning why it failed
+func (settings BuildSettings) smokeTest(path string, target common.SystemType) error {
+	if !settings.SmokeTest {
+		return nil
+	}
+	if target != common.HostSystemType() {
+		settings.logger().Verbosef("Skipping smoke test of %s, it can't run on this machine", target.ToString())
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), smokeTestTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, path, "--selftest").CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s did not exit within %s", path, smokeTestTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
 	}
-	common.PrintVerbose("All complies finished. Binaries at:", buildDir)
 	return nil
 }
 
+//Magic numbers that executables start with, by OS
+//Anything not listed here is assumed to use ELF
+var executableMagic = map[common.OS][][]byte{
+	common.Linux:   {[]byte("\x7fELF")},
+	common.Windows: {[]byte("MZ")},
+	common.OSx: {
+		{0xfe, 0xed, 0xfa, 0xce},
+		{0xfe, 0xed, 0xfa, 0xcf},
+		{0xce, 0xfa, 0xed, 0xfe},
+		{0xcf, 0xfa, 0xed, 0xfe},
+	},
+}
+
+// Procedure:
+//  checkExecutable
+// Purpose:
+//  To make sure go build really left a binary behind
+// Parameters:
+//  The path of the built binary: path string
+//  What it was built for: target common.SystemType
+// Produces:
+//  What is wrong with the binary, if anything: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  err is nil only if path is a non-empty file starting with the
+//    magic number of an executable for target's OS
+func checkExecutable(path string, target common.SystemType) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return fmt.Errorf("%s is empty or not a file", path)
+	}
+
+	header := make([]byte, 4)
+	n, _ := io.ReadFull(file, header)
+	magics, known := executableMagic[target.OS]
+	if !known {
+		magics = executableMagic[common.Linux]
+	}
+	for _, magic := range magics {
+		if bytes.HasPrefix(header[:n], magic) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s does not look like a %s executable", path, target.OS.ToString())
+}
+
+//Path of the binary built for target
+func (settings BuildSettings) builtName(buildDir string, target common.SystemType) string {
+	builtName := filepath.Join(buildDir, settings.OutputPrefix + target.ToString())
+	if target.OS == common.Windows {
+		builtName = builtName + ".exe"
+	}
+	return builtName
+}
+
 // Procedure:
 //  handleBuildCerts
 // Purpose:
@@ -153,26 +901,69 @@ func Build(settings BuildSettings) error {
 //  The root certificate: rootCert *x509.Certificate
 //  The PEM encoded root certificate: rootCertPEM []byte
 //  The build target: target common.SystemType
+//  The subject of the client certificate: subject cert.Subject
 // Produces:
 //  File system side effects
 //  The string to be added to ldflags on the build, ldflagsString string
+//  What was issued, without the binary filled in: record ClientCertRecord
 // Preconditions:
 //  rootCert and rootKey are a valid certificate key pair
 //  rootCert can sign certificates
 // Postconditions:
 //  A unique file is generated in the certs dir
-func handleBuildCerts(rootKey *rsa.PrivateKey, rootCert *x509.Certificate, rootCertPEM []byte, target common.SystemType) string {
+func handleBuildCerts(rootKey *rsa.PrivateKey, rootCert *x509.Certificate, rootCertPEM []byte, target common.SystemType, subject cert.Subject) (string, ClientCertRecord) {
 	b64encode := base64.StdEncoding.EncodeToString
 
-	certName := target.ToString() + "-" + time.Now().String()
-	PEMClientPrivateKey, PEMClientCert := cert.GenClientCert(certName, rootCert, rootKey)
+	issued := time.Now()
+	certName := target.ToString() + "-" + issued.String()
+	PEMClientPrivateKey, PEMClientCert := cert.GenClientCert(certName, subject, rootCert, rootKey)
+	record := ClientCertRecord{Target: target.ToString(), CertName: certName, Issued: issued}
+	//GenClientCert always produces a PEM certificate
+	_ = record.setSerial(PEMClientCert)
 
 	b64clientPrivateKey := b64encode(PEMClientPrivateKey)
 	b64clientCert := b64encode(PEMClientCert)
 	b64serverCert := b64encode(rootCertPEM)
 
-	ldflagsString := "-X b64clientPrivateKey=" + b64clientPrivateKey
-	ldflagsString += " -X b64clientCert=" + b64clientCert
-	ldflagsString += " -X b64serverCert=" + b64serverCert
+	return ldflagsFor(b64clientPrivateKey, b64clientCert, b64serverCert), record
+}
+
+//Files in buildDir that Clean removes: regular files named with
+//settings.OutputPrefix that no current target builds
+func (settings BuildSettings) staleArtifacts(buildDir string) ([]string, error) {
+	//Without a prefix, every file in the dir would look like an artifact
+	if settings.OutputPrefix == "" {
+		return nil, nil
+	}
+	entries, err := ioutil.ReadDir(buildDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	current := map[string]bool{certIndexFilename: true}
+	for _, target := range settings.Targets {
+		current[filepath.Base(settings.builtName(buildDir, target))] = true
+	}
+	if settings.MacUniversal {
+		current[filepath.Base(settings.universalName(buildDir))] = true
+	}
+	var stale []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Mode().IsRegular() && strings.HasPrefix(name, settings.OutputPrefix) && !current[name] {
+			stale = append(stale, filepath.Join(buildDir, name))
+		}
+	}
+	return stale, nil
+}
+
+//Builds the ldflags that set the client's compiled in certificates
+func ldflagsFor(b64clientPrivateKey, b64clientCert, b64serverCert string) string {
+	//-X needs the variable's full name, and the client is package main.
+	//The linker silently ignores names that don't match a variable.
+	ldflagsString := "-X main.b64clientPrivateKey=" + b64clientPrivateKey
+	ldflagsString += " -X main.b64clientCert=" + b64clientCert
+	ldflagsString += " -X main.b64serverCert=" + b64serverCert
 	return ldflagsString
 }
@@ -0,0 +1,588 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"os"
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+	"strings"
+	"testing"
+
+	cert "github.com/yourfin/transcodebot/certificate"
+	"github.com/yourfin/transcodebot/common"
+)
+
+func TestMain(m *testing.M) {
+	settingsDir, err := ioutil.TempDir("", "transcodebot-settings-")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	common.SetSettingsDir(settingsDir)
+	//Created up front so nothing asks before creating them
+	for _, dir := range []string{"cert", build_extention} {
+		if err = os.MkdirAll(common.SettingsDir(dir), 0755); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	code := m.Run()
+	_ = os.RemoveAll(settingsDir)
+	os.Exit(code)
+}
+
+//Logger that keeps what it's given, for checking in tests
+type recordingLogger struct {
+	mux    sync.Mutex
+	infos  []string
+	errors []string
+	//Panic on the first error, like a Logger that exits would
+	giveUp bool
+}
+
+func (logger *recordingLogger) Infof(format string, args ...interface{}) {
+	logger.mux.Lock()
+	defer logger.mux.Unlock()
+	logger.infos = append(logger.infos, fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) Errorf(format string, args ...interface{}) {
+	logger.mux.Lock()
+	defer logger.mux.Unlock()
+	logger.errors = append(logger.errors, fmt.Sprintf(format, args...))
+	if logger.giveUp {
+		panic(logger.errors[0])
+	}
+}
+
+func (logger *recordingLogger) Verbosef(format string, args ...interface{}) {}
+
+//Writes files, keyed by name, into a new temporary directory
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+//Generates the root certificate Build signs clients with, if there isn't one
+func ensureRootCert(t *testing.T) {
+	t.Helper()
+	if _, err := os.Stat(common.SettingsDir("cert", "root.crt")); err == nil {
+		return
+	}
+	cert.GenRootCert([]net.IP{net.IPv4(127, 0, 0, 1)}, nil, cert.Subject{})
+}
+
+//Every file under dir, relative to it
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			relative, _ := filepath.Rel(dir, path)
+			files = append(files, relative)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestBuildRecordsCertsOfBuiltTargetsWhenOthersFail(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles real clients")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not on the PATH")
+	}
+	host := common.HostSystemType()
+	var broken common.SystemType
+	for _, target := range common.SupportedSystemTypes() {
+		if target.OS != host.OS {
+			broken = target
+			break
+		}
+	}
+	ensureRootCert(t)
+	clientDir := writeTestFiles(t, map[string]string{
+		"go.mod":  "module client\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+		//Only compiled for the broken target's OS
+		"broken_" + broken.OS.ToString() + ".go": "package main\n\nvar broken int = \"not an int\"\n",
+	})
+
+	tests := []struct {
+		name   string
+		giveUp bool
+	}{
+		{"logger carries on", false},
+		{"logger gives up on the first error", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			logger := &recordingLogger{giveUp: test.giveUp}
+			var err error
+			func() {
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						err = fmt.Errorf("%v", recovered)
+					}
+				}()
+				_, err = BuildWithResults(BuildSettings{
+					OutputPrefix:    "test-client-",
+					OutputDir:       outputDir,
+					Targets:         []common.SystemType{host, broken},
+					ClientSourceDir: clientDir,
+					Logger:          logger,
+				})
+			}()
+			if err == nil {
+				t.Fatalf("building %s should have failed", broken.ToString())
+			}
+			if len(logger.errors) == 0 {
+				t.Errorf("the failure of %s was not logged", broken.ToString())
+			}
+
+			records, err := ReadCertIndex(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("expected a record for just %s, got %v", host.ToString(), records)
+			}
+			if records[0].Target != host.ToString() || records[0].Binary != "test-client-" + host.ToString() {
+				t.Errorf("record %+v is not for the %s binary", records[0], host.ToString())
+			}
+		})
+	}
+}
+
+func TestBuiltClientsCarryTheirCerts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles real clients")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not on the PATH")
+	}
+	ensureRootCert(t)
+	host := common.HostSystemType()
+	//Declared as in the real client, printing what the build set them to
+	clientDir := writeTestFiles(t, map[string]string{
+		"go.mod": "module client\n",
+		"main.go": "package main\n\nimport \"fmt\"\n\n" +
+			"var (\n\tb64serverCert string\n\tb64clientPrivateKey string\n\tb64clientCert string\n)\n\n" +
+			"func main() {\n\tfmt.Println(b64serverCert)\n\tfmt.Println(b64clientPrivateKey)\n\tfmt.Println(b64clientCert)\n}\n",
+	})
+	outputDir := t.TempDir()
+	logger := &recordingLogger{}
+	settings := BuildSettings{
+		OutputPrefix:    "test-client-",
+		OutputDir:       outputDir,
+		Targets:         []common.SystemType{host},
+		ClientSourceDir: clientDir,
+		Logger:          logger,
+	}
+	if _, err := BuildWithResults(settings); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(settings.builtName(outputDir, host)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected the three certificate variables, got %q", output)
+	}
+	decoded := make([][]byte, len(lines))
+	for ii, line := range lines {
+		decoded[ii], err = base64.StdEncoding.DecodeString(line)
+		if err != nil || len(decoded[ii]) == 0 {
+			t.Fatalf("variable %d is %q, not a base64 certificate: %v", ii, line, err)
+		}
+	}
+	serverCert, clientKey, clientCert := decoded[0], decoded[1], decoded[2]
+
+	rootCert, err := ioutil.ReadFile(common.SettingsDir("cert", "root.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serverCert, rootCert) {
+		t.Error("the server certificate is not the root certificate")
+	}
+	if block, _ := pem.Decode(clientKey); block == nil {
+		t.Error("the client private key is not PEM encoded")
+	}
+	for _, message := range append(logger.infos, logger.errors...) {
+		if strings.Contains(message, lines[1]) {
+			t.Errorf("the client private key was logged: %s", message)
+		}
+	}
+	var embedded ClientCertRecord
+	if err = embedded.setSerial(clientCert); err != nil {
+		t.Fatal(err)
+	}
+	records, err := ReadCertIndex(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Serial != embedded.Serial {
+		t.Errorf("client certificate %s is not the one recorded in %v", embedded.Serial, records)
+	}
+}
+
+//Swaps the root certificate out for whatever replace leaves in its
+//place, putting the real one back once the test is done
+func replaceRootCert(t *testing.T, replace func(path string) error) {
+	t.Helper()
+	ensureRootCert(t)
+	path := common.SettingsDir("cert", "root.crt")
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(path)
+		if err := ioutil.WriteFile(path, saved, 0644); err != nil {
+			t.Error(err)
+		}
+	})
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = replace(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildFailsWithoutUsableRootCert(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace func(path string) error
+		//What the error should mention
+		want string
+	}{
+		{"missing", func(path string) error { return nil }, "root certificate missing"},
+		{"empty", func(path string) error { return ioutil.WriteFile(path, nil, 0644) }, "is empty"},
+		{"blank", func(path string) error { return ioutil.WriteFile(path, []byte("\n\n"), 0644) }, "is empty"},
+		{"unreadable", func(path string) error { return os.Mkdir(path, 0755) }, "reading root certificate"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replaceRootCert(t, test.replace)
+			outputDir := t.TempDir()
+			_, err := BuildWithResults(BuildSettings{
+				OutputDir:       outputDir,
+				Targets:         []common.SystemType{common.HostSystemType()},
+				ClientSourceDir: writeTestFiles(t, map[string]string{"main.go": "package main\n\nfunc main() {}\n"}),
+				Logger:          &recordingLogger{},
+			})
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("expected an error about %q, got %v", test.want, err)
+			}
+			if files := listFiles(t, outputDir); len(files) != 0 {
+				t.Errorf("built %v without a root certificate", files)
+			}
+		})
+	}
+}
+
+func TestBuildLeavesWorkingDirAlone(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles real clients")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not on the PATH")
+	}
+	ensureRootCert(t)
+	original, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir := writeTestFiles(t, map[string]string{
+		"go.mod":  "module client\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	})
+
+	tests := []struct {
+		name string
+		//Delete the working directory first, so nothing could chdir back to it
+		deleted bool
+	}{
+		{"working dir kept", false},
+		{"working dir deleted", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			workingDir := filepath.Join(t.TempDir(), "working")
+			if err := os.Mkdir(workingDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(workingDir); err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := os.Chdir(original); err != nil {
+					t.Fatal(err)
+				}
+			}()
+			if test.deleted {
+				if err := os.Remove(workingDir); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			settings := BuildSettings{
+				OutputPrefix:    "test-client-",
+				OutputDir:       t.TempDir(),
+				Targets:         []common.SystemType{common.HostSystemType()},
+				ClientSourceDir: clientDir,
+				Logger:          &recordingLogger{},
+			}
+			var err error
+			func() {
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						t.Errorf("Build panicked: %v", recovered)
+					}
+				}()
+				_, err = BuildWithResults(settings)
+			}()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.deleted {
+				if current, err := os.Getwd(); err != nil || current != workingDir {
+					t.Errorf("working dir is %s, %v after building; expected %s", current, err, workingDir)
+				}
+			}
+			if _, err = os.Stat(settings.builtName(settings.OutputDir, common.HostSystemType())); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDryRunWritesNothing(t *testing.T) {
+	clientDir := writeTestFiles(t, map[string]string{"main.go": "package main\n\nfunc main() {}\n"})
+	tests := []struct {
+		name string
+		//Sets up the settings dir and build dir before the dry run
+		prepare func(t *testing.T, settings *BuildSettings)
+	}{
+		{"root certificate present", func(t *testing.T, settings *BuildSettings) {
+			ensureRootCert(t)
+		}},
+		{"root certificate missing", func(t *testing.T, settings *BuildSettings) {
+			replaceRootCert(t, func(path string) error { return nil })
+			settings.ServerIPs = []net.IP{net.IPv4(127, 0, 0, 1)}
+		}},
+		{"new certificate forced", func(t *testing.T, settings *BuildSettings) {
+			ensureRootCert(t)
+			settings.ForceNewCert = true
+			settings.ServerIPs = []net.IP{net.IPv4(127, 0, 0, 1)}
+		}},
+		{"stale artifacts to clean", func(t *testing.T, settings *BuildSettings) {
+			ensureRootCert(t)
+			settings.OutputDir = writeTestFiles(t, map[string]string{"test-client-old": "stale"})
+			settings.Clean = true
+		}},
+		{"default build dir", func(t *testing.T, settings *BuildSettings) {
+			ensureRootCert(t)
+			settings.OutputDir = ""
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := BuildSettings{
+				OutputPrefix:    "test-client-",
+				//Not created yet, and shouldn't be
+				OutputDir:       filepath.Join(t.TempDir(), "clients"),
+				Targets:         []common.SystemType{common.HostSystemType()},
+				ClientSourceDir: clientDir,
+				Logger:          &recordingLogger{},
+				DryRun:          true,
+			}
+			test.prepare(t, &settings)
+			buildDir := settings.outputDir()
+			settingsBefore := listFiles(t, common.SettingsDir())
+			buildBefore := listFiles(t, buildDir)
+			_, buildDirErr := os.Stat(buildDir)
+
+			if _, err := BuildWithResults(settings); err != nil {
+				t.Fatal(err)
+			}
+
+			if after := listFiles(t, common.SettingsDir()); strings.Join(after, "\n") != strings.Join(settingsBefore, "\n") {
+				t.Errorf("settings dir went from %v to %v", settingsBefore, after)
+			}
+			if after := listFiles(t, buildDir); strings.Join(after, "\n") != strings.Join(buildBefore, "\n") {
+				t.Errorf("build dir went from %v to %v", buildBefore, after)
+			}
+			if _, err := os.Stat(buildDir); os.IsNotExist(buildDirErr) && !os.IsNotExist(err) {
+				t.Errorf("build dir %s was created", buildDir)
+			}
+		})
+	}
+}
+
+func TestDetectorsOnlyBuildForThisMachine(t *testing.T) {
+	host := common.HostSystemType()
+	var other common.SystemType
+	for _, target := range common.SupportedSystemTypes() {
+		if target != host {
+			other = target
+			break
+		}
+	}
+	hostHas := func(supported []common.SystemType) bool {
+		for _, target := range supported {
+			if target == host {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		targets []common.SystemType
+		//What the error should mention, "" if there shouldn't be one
+		want string
+	}{
+		{"normal build elsewhere", "", []common.SystemType{other}, ""},
+		{"pie elsewhere", "pie", []common.SystemType{other}, ""},
+		{"race here", "race", []common.SystemType{host}, ""},
+		{"msan here", "msan", []common.SystemType{host}, ""},
+		{"race here and elsewhere", "race", []common.SystemType{host, other}, other.ToString()},
+		{"msan elsewhere", "msan", []common.SystemType{other}, other.ToString()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := test.want
+			if want == "" && (test.mode == "race" && !hostHas(raceTargets) || test.mode == "msan" && !hostHas(msanTargets)) {
+				want = "go has no " + test.mode + " detector"
+			}
+			err := ValidateDetectorTargets(test.mode, test.targets)
+			if want == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+				t.Fatalf("expected an error about %s, got %v", want, err)
+			}
+			if want == "" {
+				return
+			}
+
+			//Build gives up before doing anything, even for a dry run
+			ensureRootCert(t)
+			logger := &recordingLogger{}
+			_, err = BuildWithResults(BuildSettings{
+				OutputDir: t.TempDir(),
+				Targets:   test.targets,
+				BuildMode: test.mode,
+				Logger:    logger,
+				DryRun:    true,
+			})
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("expected Build to fail with an error about %s, got %v", want, err)
+			}
+			if len(logger.infos) != 0 {
+				t.Errorf("logged %v before failing", logger.infos)
+			}
+		})
+	}
+}
+
+func TestRetriesOnlyFailedCompiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles real clients")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not on the PATH")
+	}
+	ensureRootCert(t)
+	tests := []struct {
+		name  string
+		files map[string]string
+		//Printed by go build whether or not it succeeds
+		goFlags string
+		fails   bool
+	}{
+		{"quiet success", map[string]string{"main.go": "package main\n\nfunc main() {}\n"}, "", false},
+		//-x prints every command go build runs, like the downloads of a module build
+		{"success with output", map[string]string{"main.go": "package main\n\nfunc main() {}\n"}, "-x", false},
+		{"source error", map[string]string{"main.go": "package main\n\nfunc main() { undefined() }\n"}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := map[string]string{"go.mod": "module client\n"}
+			for name, content := range test.files {
+				files[name] = content
+			}
+			logger := &recordingLogger{}
+			_, err := BuildWithResults(BuildSettings{
+				OutputPrefix:    "test-client-",
+				OutputDir:       t.TempDir(),
+				Targets:         []common.SystemType{common.HostSystemType()},
+				ClientSourceDir: writeTestFiles(t, files),
+				GoFlags:         test.goFlags,
+				Retries:         1,
+				Logger:          logger,
+			})
+			if test.fails && err == nil {
+				t.Fatal("expected the build to fail")
+			}
+			if !test.fails && err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range logger.infos {
+				if strings.Contains(info, "retrying") {
+					t.Errorf("retried: %s", info)
+				}
+			}
+		})
+	}
+}
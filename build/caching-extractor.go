@@ -0,0 +1,139 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"sync"
+	"container/list"
+)
+
+// Type:
+//  CachingExtractor
+// Purpose:
+//  To keep the decompressed contents of recently read blocks in memory,
+//    so that a long running client reading the same small blocks over
+//    and over doesn't decompress them every time
+// Notes:
+//  Only ByteArray is cached. GetReader streams from the file as usual.
+type CachingExtractor struct {
+	*BinAppendExtractor
+
+	//Most total bytes of block contents to hold on to
+	maxBytes int64
+	//Bytes currently held
+	usedBytes int64
+	//Most recently used at the front, holding *cacheEntry
+	recent  *list.List
+	entries map[string]*list.Element
+	mux     sync.Mutex
+}
+
+type cacheEntry struct {
+	name string
+	data []byte
+}
+
+// Procedure:
+//  NewCachingExtractor
+// Purpose:
+//  To create a CachingExtractor
+// Parameters:
+//  The extractor to read through: base *BinAppendExtractor
+//  The most bytes of block contents to cache: maxBytes int64
+// Produces:
+//  The new extractor: output *CachingExtractor
+// Preconditions:
+//  base is not used to change settings, e.g. CaseInsensitive, once
+//    blocks have been cached
+// Postconditions:
+//  Every method of base is still available on output
+//  Blocks bigger than maxBytes are never cached
+func NewCachingExtractor(base *BinAppendExtractor, maxBytes int64) *CachingExtractor {
+	return &CachingExtractor{
+		BinAppendExtractor: base,
+		maxBytes:           maxBytes,
+		recent:             list.New(),
+		entries:            make(map[string]*list.Element),
+	}
+}
+
+// Procedure:
+//  *CachingExtractor.ByteArray
+// Purpose:
+//  To read all of a block as BinAppendExtractor.ByteArray does,
+//    from memory if it has been read recently
+// Parameters:
+//  The parent *CachingExtractor: extractor
+//  The name of the data to retrieve: dataName string
+// Produces:
+//  The data named dataName: data []byte
+//  Any errors raised: err error
+// Preconditions:
+//  As for BinAppendExtractor.ByteArray
+// Postconditions:
+//  data is the caller's own copy; changing it doesn't change the cache
+//  Once the cache holds more than its budget, the least recently
+//    read blocks are dropped until it fits
+//  Errors are not cached
+func (extractor *CachingExtractor) ByteArray(dataName string) ([]byte, error) {
+	extractor.mux.Lock()
+	if element, found := extractor.entries[dataName]; found {
+		extractor.recent.MoveToFront(element)
+		data := append([]byte{}, element.Value.(*cacheEntry).data...)
+		extractor.mux.Unlock()
+		return data, nil
+	}
+	extractor.mux.Unlock()
+
+	//Read without the lock, so slow blocks don't hold up cached ones
+	data, err := extractor.BinAppendExtractor.ByteArray(dataName)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > extractor.maxBytes {
+		return data, nil
+	}
+
+	extractor.mux.Lock()
+	defer extractor.mux.Unlock()
+	//Someone else may have read it in the meantime
+	if _, found := extractor.entries[dataName]; !found {
+		entry := &cacheEntry{name: dataName, data: append([]byte{}, data...)}
+		extractor.entries[dataName] = extractor.recent.PushFront(entry)
+		extractor.usedBytes += int64(len(data))
+		for extractor.usedBytes > extractor.maxBytes {
+			oldest := extractor.recent.Remove(extractor.recent.Back()).(*cacheEntry)
+			delete(extractor.entries, oldest.name)
+			extractor.usedBytes -= int64(len(oldest.data))
+		}
+	}
+	return data, nil
+}
+
+//Drops every cached block
+func (extractor *CachingExtractor) Purge() {
+	extractor.mux.Lock()
+	defer extractor.mux.Unlock()
+	extractor.recent.Init()
+	extractor.entries = make(map[string]*list.Element)
+	extractor.usedBytes = 0
+}
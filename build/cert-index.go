@@ -0,0 +1,137 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package build
+
+import (
+	"os"
+	"time"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"encoding/pem"
+	"crypto/x509"
+)
+
+//Name of the file in the build dir recording every client certificate
+//that made it into a binary
+const certIndexFilename = "client-certs.json"
+
+//Which client certificate was built into which binary
+type ClientCertRecord struct {
+	//Name of the built binary, relative to the build dir
+	Binary string `json:"binary"`
+	Target string `json:"target"`
+	//Name the certificate files were saved under in the cert dir
+	CertName string `json:"cert_name"`
+	//Serial number of the certificate, in hex
+	Serial string `json:"serial"`
+	Issued time.Time `json:"issued"`
+}
+
+//Fills in the serial number of record from a PEM encoded certificate
+func (record *ClientCertRecord) setSerial(PEMCert []byte) error {
+	block, _ := pem.Decode(PEMCert)
+	if block == nil {
+		return errors.New("client certificate is not PEM encoded")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	record.Serial = certificate.SerialNumber.Text(16)
+	return nil
+}
+
+// Procedure:
+//  ReadCertIndex
+// Purpose:
+//  To list the client certificates built into binaries so far
+// Parameters:
+//  The build dir holding the index: buildDir string
+// Produces:
+//  Every record, oldest first: records []ClientCertRecord
+//  Any errors reading the index: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  records is empty, not an error, if nothing has been built yet
+func ReadCertIndex(buildDir string) ([]ClientCertRecord, error) {
+	var records []ClientCertRecord
+	data, err := ioutil.ReadFile(filepath.Join(buildDir, certIndexFilename))
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &records)
+	return records, err
+}
+
+// Procedure:
+//  appendCertIndex
+// Purpose:
+//  To add records to the build dir's certificate index
+// Parameters:
+//  The build dir holding the index: buildDir string
+//  The records to add: records []ClientCertRecord
+// Produces:
+//  Any errors reading or writing the index: err error
+// Preconditions:
+//  Only one build writes to buildDir at a time
+// Postconditions:
+//  Earlier records are kept
+//  The new index is written to a temporary file and renamed into
+//    place, so the index is never left half written
+func appendCertIndex(buildDir string, records []ClientCertRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	existing, err := ReadCertIndex(buildDir)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(append(existing, records...), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(buildDir, certIndexFilename + ".")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if err == nil {
+		err = tempFile.Close()
+	} else {
+		_ = tempFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), filepath.Join(buildDir, certIndexFilename))
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"encoding/pem"
+	"crypto/x509"
+)
+
+//Name of the block each built client carries its server (root) certificate in
+const serverCertBlock = "serverCert"
+
+//Packs the PEM encoded server certificate onto the end of a built binary,
+//so that it can be checked with ExtractEmbeddedServerCert
+func packServerCert(binaryPath string, rootCertPEM []byte) error {
+	appender, err := MakeAppender(binaryPath)
+	if err != nil {
+		return err
+	}
+	err = appender.AppendStreamReader(serverCertBlock, bytes.NewReader(rootCertPEM))
+	closeErr := appender.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Procedure:
+//  ExtractEmbeddedServerCert
+// Purpose:
+//  To read back the server certificate a client was built with
+// Parameters:
+//  The path of the built client: binaryPath string
+// Produces:
+//  The certificate: certificate *x509.Certificate
+//  Any errors in reading or parsing it: err error
+// Preconditions:
+//  binaryPath was built by Build
+// Postconditions:
+//  certificate is parsed from the serverCert block packed onto the binary
+//  err is non-nil if the block is missing or isn't a PEM certificate
+func ExtractEmbeddedServerCert(binaryPath string) (*x509.Certificate, error) {
+	extractor, err := MakeAppendExtractor(binaryPath)
+	if err != nil {
+		return nil, err
+	}
+	PEMCert, err := extractor.ByteArray(serverCertBlock)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(PEMCert)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New(fmt.Sprintf("%s block of %s is not a PEM certificate", serverCertBlock, binaryPath))
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -23,31 +23,252 @@ package build
 import (
 	"os"
 	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"net/http"
+	"net/url"
+	"bufio"
 	"compress/gzip"
+	"compress/zlib"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"context"
+	"syscall"
+	"archive/tar"
+	"strings"
+	"strconv"
+	"time"
 	"sync"
+	"sync/atomic"
 	"errors"
 	"fmt"
 	"encoding/json"
-	"encoding/binary"
 )
 
 type appendedData struct {
 	//TODO: Copy to temp file before opening a reader
 	//TODO: CopyToTmp bool
 	StartFilePtr int64 `json:"start_file_pointer"`
+	//Size of the block in the file, whether or not it is compressed
 	ZippedSize   int64 `json:"zipped_block_size"`
+	//Size of the data before compression, 0 if unknown
+	UnzippedSize int64 `json:"unzipped_size,omitempty"`
+	//The block was stored as is because gzip made it bigger.
+	//Inverted from "compressed" so that blocks in older files,
+	//which are all gzipped, read back correctly.
+	Stored bool `json:"stored,omitempty"`
+	//Permission bits of the appended file, 0 if unknown,
+	//e.g. for streams or files packed by older versions
+	Mode os.FileMode `json:"mode,omitempty"`
+	//How the compressed block is framed, empty for gzip so that
+	//older files read back correctly. Meaningless if Stored.
+	Framing Framing `json:"framing,omitempty"`
+	//Free form key/value pairs about the block, e.g. a content type
+	Attributes map[string]string `json:"attributes,omitempty"`
+	//Name of the block holding the preset dictionary the block was
+	//compressed with, see BinAppender.UseDictionary
+	Dictionary string `json:"dictionary,omitempty"`
+	//Hex encoded hash of the uncompressed data, and which hash it is.
+	//Both empty for blocks packed without one.
+	Checksum string   `json:"checksum,omitempty"`
+	HashAlgo HashAlgo `json:"hash_algo,omitempty"`
 }
 
-const METADATA_VERSION string = "0.1"
+//Start of the names of blocks holding compression dictionaries,
+//followed by the start of the dictionary's SHA-256
+const dictionaryBlockPrefix = "transcodebot-dictionary-"
+
+//Container format around a compressed block
+type Framing string
+
+const (
+	//compress/gzip, the default
+	FramingGzip Framing = ""
+	//compress/zlib, for consumers that only speak zlib
+	FramingZlib Framing = "zlib"
+	//compress/flate with no header or checksum at all
+	FramingDeflate Framing = "deflate"
+	//Encoded by the caller of ReserveBlock; read back as is
+	FramingCustom Framing = "custom"
+)
+
+//Name of the framing for display, since gzip is stored as ""
+func (framing Framing) ToString() string {
+	if framing == FramingGzip {
+		return "gzip"
+	}
+	return string(framing)
+}
+
+//Counts the bytes written through it
+type writeCounter struct {
+	count int64
+}
+
+func (counter *writeCounter) Write(p []byte) (int, error) {
+	counter.count += int64(len(p))
+	return len(p), nil
+}
+
+//Format version written by BinAppender
+const MetadataVersion string = "0.1"
+//Old name for MetadataVersion
+const METADATA_VERSION string = MetadataVersion
+
+//Default for BinAppender.WriteBufferSize
+const defaultWriteBufferSize = 64 * 1024
+
+// Procedure:
+//  SupportedVersions
+// Purpose:
+//  To list the format versions this package can extract
+// Parameters:
+//  None
+// Produces:
+//  The supported versions: versions []string
+// Preconditions:
+//  No additional
+// Postconditions:
+//  versions always includes MetadataVersion
+//  Appending always needs MetadataVersion exactly
+func SupportedVersions() []string {
+	return []string{MetadataVersion}
+}
+
+//Whether files packed with version can be extracted
+func versionSupported(version string) bool {
+	for _, supported := range SupportedVersions() {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
 type appendedMetadata struct {
 	Version string
 	Data    map[string]appendedData
 }
 
+//Returned by a BinAppender's methods once it has been closed or finalized
+var ErrAlreadyClosed = errors.New("appender already closed")
+
+//What appending a file under a name that's already taken does
+type DuplicatePolicy int
+
+const (
+	//Fail the append
+	DuplicateError DuplicatePolicy = iota
+	//Append the file and point the name at it. The old block's
+	//bytes are left in the file, unreferenced.
+	DuplicateReplace
+	//Leave the existing block and append nothing
+	DuplicateSkip
+)
+
 type BinAppender struct {
+	//Write the index as a binary table instead of json,
+	//so that extractors can look up names without decoding the
+	//whole index. Worth it for archives with thousands of blocks.
+	//Default false
+	BinaryIndex bool
+
+	//Indent the json index to make it readable when inspecting
+	//the end of a packed file by hand. Ignored with BinaryIndex.
+	//Either way encoding/json writes the names in sorted order, so
+	//the same blocks always produce the same bytes.
+	//Default false
+	IndentIndex bool
+
+	//Gzip the json index, which shrinks archives with thousands of
+	//blocks noticeably. Left off by default so the index can be read
+	//straight out of the file. Ignored with BinaryIndex.
+	//Default false
+	CompressIndex bool
+
+	//Framing for blocks appended from here on. Can be changed between
+	//appends; each block records its own.
+	//Default FramingGzip
+	Framing Framing
+
+	//Split each block into chunks and gzip them concurrently.
+	//Only applies to FramingGzip.
+	//The chunks are separate gzip members, which gzip readers
+	//read back as one stream.
+	//Default false
+	ParallelCompress bool
+	//Number of chunks to compress at once with ParallelCompress
+	//Default (0) is the number of CPUs
+	CompressWorkers int
+
+	//Store blocks as is without trying to compress them, which is much
+	//faster when size doesn't matter, e.g. while developing
+	//Default false
+	FastPack bool
+
+	//Size of the buffer between the compressor and the file, which
+	//batches gzip's small writes into fewer syscalls.
+	//BenchmarkAppendWriteBufferSizes compares sizes.
+	//Default (0) is defaultWriteBufferSize, negative turns buffering off
+	WriteBufferSize int
+
+	//Directory to also write each block's uncompressed bytes to as it's
+	//appended, for checking what went in against what comes out.
+	//Files are named after the blocks, with / and other special
+	//characters escaped.
+	//Default ("") writes nothing
+	DebugDumpDir string
+
+	//What AppendFile and friends do with names already in the index
+	//Default DuplicateError
+	OnDuplicate DuplicatePolicy
+
+	//Hash of each block's uncompressed data to record in the index,
+	//for extractors to check blocks against. HashNone records nothing.
+	//Default ("") is HashCRC32
+	HashAlgo HashAlgo
+
+	//Largest a block may be once packed, in bytes. Appends of bigger
+	//blocks fail with nothing appended.
+	//Default (0) is no limit
+	MaxBlockSize int64
+	//Largest the file may grow to through appends, in bytes, not
+	//counting the index Close writes. Appends that would grow it
+	//past this fail with nothing appended.
+	//Default (0) is no limit
+	MaxTotalSize int64
+
+	//Have Close sync the blocks to disk before writing the index, and
+	//the index after, so losing power can't leave an index pointing at
+	//blocks that never made it to disk. FinalizeAtomic always does this.
+	//Default false
+	Durable bool
+
+	//Fail AppendTar on symlinks, devices, and other members that
+	//aren't regular files or directories, instead of skipping them
+	//Default false
+	RejectTarSpecialFiles bool
+
 	fileHandle *os.File
 	metadata   appendedMetadata
 	mux        *sync.Mutex
+	//Signalled on mux whenever inFlight drops
+	idle *sync.Cond
+	//Number of blocks reserved with reserve but not yet written
+	inFlight int
+	//Number of appendStream calls running, read and written atomically
+	appending int32
+	//End of the last reserved block, only meaningful while inFlight > 0
+	endPtr int64
+	//If set, the index is written here instead of to the end of fileHandle
+	sidecarFilename string
+	//Set once Close or FinalizeAtomic has started
+	closed bool
+	//Preset dictionary from UseDictionary, and the block holding it
+	dictionary     []byte
+	dictionaryName string
 }
 
 // Procedure:
@@ -67,20 +288,261 @@ type BinAppender struct {
 // Postconditions:
 //  An appender is created that will append to filename through writeWrapper
 //  The caller of this function closes the created BinAppender
+//  If $filename already ends in a metadata trailer from a previous
+//    BinAppender, the existing data is kept and the old trailer is
+//    truncated off so that appending continues where it left off
+//  Before anything is cut off, the file's length and old trailer are
+//    recorded in $filename.undo, which Close removes once the new
+//    index is written. If the process dies before then, RepairArchive
+//    uses it to put the file back.
+//  err is non-nil if $filename has no trailer but has an undo record,
+//    since an earlier append never finished and needs RepairArchive
 func MakeAppender(filename string) (*BinAppender, error) {
 	var err error
 	output := BinAppender{}
-	output.fileHandle, err = os.OpenFile(filename, os.O_RDWR, 0755)
+	output.fileHandle, err = openForAppend(filename)
+	if err != nil {
+		return nil, err
+	}
+	output.mux = &sync.Mutex{}
+	output.idle = sync.NewCond(output.mux)
+	output.metadata = appendedMetadata{}
+	output.metadata.Data = make(map[string]appendedData)
+	output.metadata.Version = MetadataVersion
+
+	existing, metadataPtr, found, err := findExistingMetadata(output.fileHandle)
+	if err != nil {
+		_ = output.fileHandle.Close()
+		return nil, err
+	}
+	if !found {
+		//The record is all that's left of the index an unfinished
+		//append cut off, and recording again would replace it
+		if _, err = os.Stat(undoFilename(filename)); err == nil {
+			_ = output.fileHandle.Close()
+			return nil, errors.New(fmt.Sprintf("an earlier append to %s never finished; repair it with RepairArchive first", filename))
+		}
+		var info os.FileInfo
+		info, err = output.fileHandle.Stat()
+		if err != nil {
+			_ = output.fileHandle.Close()
+			return nil, err
+		}
+		metadataPtr = info.Size()
+	}
+	err = writeUndo(output.fileHandle, metadataPtr)
+	if err != nil {
+		_ = output.fileHandle.Close()
+		return nil, err
+	}
+	if found {
+		output.metadata.Data = existing.Data
+		err = output.fileHandle.Truncate(metadataPtr)
+		if err != nil {
+			_ = output.fileHandle.Close()
+			return nil, err
+		}
+	}
+	return &output, nil
+}
+
+//Opens filename to be appended to, explaining permission problems,
+//which otherwise just say permission denied
+func openForAppend(filename string) (*os.File, error) {
+	fileHandle, err := os.OpenFile(filename, os.O_RDWR, 0755)
+	if os.IsPermission(err) {
+		return nil, errors.New(fmt.Sprintf("cannot pack into %s: permission denied; is the binary or its directory read-only?", filename))
+	}
+	if pathErr, isPathErr := err.(*os.PathError); isPathErr && pathErr.Err == syscall.EROFS {
+		return nil, errors.New(fmt.Sprintf("cannot pack into %s: it is on a read-only file system; try MakeAppenderCopy to pack a copy elsewhere", filename))
+	}
+	return fileHandle, err
+}
+
+// Procedure:
+//  MakeAppenderCopy
+// Purpose:
+//  To create a BinAppender that appends to a copy of a file,
+//    leaving the original untouched
+// Parameters:
+//  The name of the file to copy: src string
+//  The name of the copy to append to: dst string
+// Produces:
+//  A pointer to a new BinAppender: output *BinAppender
+//  Any filesystem errors that occur in copying or opening: err error
+// Preconditions:
+//  The file at src exists and can be read
+//  dst is not the same file as src
+// Postconditions:
+//  dst is created or overwritten with the contents of src and
+//    has the same permission bits as src
+//  The returned appender behaves as MakeAppender(dst)
+//  A read-only src gives a read-only dst that can still be appended
+//    to, as it's only made read-only once the appender has it open
+//  src is never modified, even if appending fails
+func MakeAppenderCopy(src string, dst string) (*BinAppender, error) {
+	err := copyFile(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return nil, err
+	}
+	mode := info.Mode().Perm()
+	if mode&0200 != 0 {
+		return MakeAppender(dst)
+	}
+
+	err = os.Chmod(dst, mode|0200)
+	if err != nil {
+		return nil, err
+	}
+	output, err := MakeAppender(dst)
+	chmodErr := os.Chmod(dst, mode)
+	if err != nil {
+		return nil, err
+	}
+	if chmodErr != nil {
+		_ = output.Close()
+		return nil, chmodErr
+	}
+	return output, nil
+}
+
+//Copies src to dst, keeping src's permission bits
+func copyFile(src string, dst string) error {
+	srcHandle, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = srcHandle.Close() }()
+	srcInfo, err := srcHandle.Stat()
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return errors.New(fmt.Sprintf("cannot copy %s onto itself", src))
+	}
+
+	dstHandle, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, srcInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dstHandle, srcHandle)
+	if err != nil {
+		_ = dstHandle.Close()
+		return err
+	}
+	//OpenFile's mode is filtered by the umask and ignored if dst existed
+	err = dstHandle.Chmod(srcInfo.Mode().Perm())
+	if err != nil {
+		_ = dstHandle.Close()
+		return err
+	}
+	return dstHandle.Close()
+}
+
+// Procedure:
+//  MakeSidecarAppender
+// Purpose:
+//  To create a BinAppender that keeps its index in a separate file,
+//    so that the appended file can be produced and consumed sequentially
+// Parameters:
+//  The name of the file to append to: filename string
+//  The name of the file to write the index to: sidecarFilename string
+// Produces:
+//  A pointer to a new BinAppender: output *BinAppender
+//  Any filesystem errors that occur in opening $filename: err error
+// Preconditions:
+//  The file at filename exists and can be written to
+//  sidecarFilename can be created or written to
+// Postconditions:
+//  Blocks are appended to $filename as with MakeAppender, but no
+//    trailer is ever written to it
+//  On Close, the index is written to $sidecarFilename
+//  If $sidecarFilename already holds an index, it is loaded and
+//    appending continues from it
+//  The caller of this function closes the created BinAppender
+func MakeSidecarAppender(filename string, sidecarFilename string) (*BinAppender, error) {
+	var err error
+	output := BinAppender{}
+	output.fileHandle, err = openForAppend(filename)
 	if err != nil {
 		return nil, err
 	}
 	output.mux = &sync.Mutex{}
+	output.idle = sync.NewCond(output.mux)
+	output.sidecarFilename = sidecarFilename
 	output.metadata = appendedMetadata{}
 	output.metadata.Data = make(map[string]appendedData)
-	output.metadata.Version = METADATA_VERSION
+	output.metadata.Version = MetadataVersion
+
+	sidecarHandle, err := os.Open(sidecarFilename)
+	if os.IsNotExist(err) {
+		return &output, nil
+	} else if err != nil {
+		_ = output.fileHandle.Close()
+		return nil, err
+	}
+	defer func() { _ = sidecarHandle.Close() }()
+	existing, _, found, err := findExistingMetadata(sidecarHandle)
+	if err != nil {
+		_ = output.fileHandle.Close()
+		return nil, err
+	}
+	if found {
+		output.metadata.Data = existing.Data
+	}
 	return &output, nil
 }
 
+// Procedure:
+//  findExistingMetadata
+// Purpose:
+//  To detect a metadata trailer left on a file by a previous BinAppender
+// Parameters:
+//  The file to check: fileHandle *os.File
+// Produces:
+//  The metadata in the trailer: metadata appendedMetadata
+//  The location of the start of the metadata: metadataPtr int64
+//  Whether a trailer was found: found bool
+//  Any filesystem errors, or a version mismatch: err error
+// Preconditions:
+//  fileHandle is open for reading
+// Postconditions:
+//  found is true only if the file ends in an index that readIndex can parse
+//  err is non-nil if a trailer is found with a version other than MetadataVersion
+//  The offset of fileHandle is undefined
+func findExistingMetadata(fileHandle *os.File) (metadata appendedMetadata, metadataPtr int64, found bool, err error) {
+	info, err := fileHandle.Stat()
+	if err != nil {
+		return metadata, 0, false, err
+	}
+
+	//Anything that doesn't parse as an index is just the tail of a normal file,
+	//but appending after a damaged index would bury its blocks for good
+	index, metadataPtr, err := readIndex(fileHandle, info.Size())
+	if err == ErrIndexCorrupted {
+		return metadata, metadataPtr, true, err
+	}
+	if err != nil || index.version() == "" {
+		return appendedMetadata{}, 0, false, nil
+	}
+	if index.version() != MetadataVersion {
+		return metadata, metadataPtr, true, errors.New(fmt.Sprintf(
+			"file already packed with metadata version %s, cannot append with version %s",
+			index.version(),
+			MetadataVersion,
+		))
+	}
+	metadata, err = readAllMetadata(index, fileHandle)
+	if err != nil {
+		return metadata, metadataPtr, true, err
+	}
+	return metadata, metadataPtr, true, nil
+}
+
 // Procedure:
 //  BinAppender.AppendStreamReader
 // Purpose:
@@ -99,120 +561,1989 @@ func MakeAppender(filename string) (*BinAppender, error) {
 //  All of the data that reader can read has been written to
 //    appender's internal writer at the end of its file
 //  appender's internal metadata has been updated to reflect the addition
-//  Errors will be filesystem related
+//  Errors will be filesystem related, or come from source
+//  If an error is returned, the metadata is unchanged. The file is
+//    truncated back to its length before the call unless other appends
+//    finished after it, in which case the space is left unused.
+//  Several may run at once. With no other append running, the stream
+//    is compressed straight onto the end of the file. Appends started
+//    while one is running are compressed to temporary files without
+//    holding any locks, and only copied into the appender's file once
+//    their size is known.
+//  If the packed block is over $appender.MaxBlockSize, or would take
+//    the file over $appender.MaxTotalSize, err says which and nothing
+//    is appended. Compressing stops as soon as the block is sure to
+//    be too big, so an endless stream doesn't fill the temporary dir.
 //
 //  bash equivalent is executed:
 //    $source | gzip >> $appender.file
+//  unless gzip made the data bigger and source is an io.Seeker, in
+//    which case the block is re-read and stored uncompressed:
+//    $source >> $appender.file
 //
 //  $appender.file.ByteArray()[$appender.metadata[$name].StartFilePtr:$appender.metadata[$name].ZippedSize].gunzip() == $source.ByteArray[]
 func (appender *BinAppender) AppendStreamReader(name string, source io.Reader) error {
-	appender.mux.Lock()
-	defer appender.mux.Unlock()
+	return appender.AppendStreamReaderContext(context.Background(), name, source)
+}
 
-	startPtr, err := appender.fileHandle.Seek(0, io.SeekEnd)
-	if err != nil {
-		return err
-	}
-	gzWriter := gzip.NewWriter(appender.fileHandle)
-	_, err = io.Copy(gzWriter, source)
-	if err != nil {
+// Procedure:
+//  BinAppender.AppendStreamReaderContext
+// Purpose:
+//  To append a stream as AppendStreamReader does, stopping if ctx is done
+// Parameters:
+//  The parent *BinAppender: appender
+//  The context bounding the append: ctx context.Context
+//  The unique name of the stream: name string
+//  The reader to pull data out of: source io.Reader
+// Produces:
+//  Any errors in writing to the filesystem, or ctx.Err(): err error
+// Preconditions:
+//  As for AppendStreamReader
+// Postconditions:
+//  As for AppendStreamReader
+//  Once ctx is done, the next read of source fails with ctx.Err(), so
+//    the append stops promptly. The metadata is left as it was. When no
+//    other append is running the stream is compressed straight onto the
+//    end of the file, and a cancelled append truncates the file back to
+//    where the block started; if that truncation fails too, err says so
+//    and the file may keep a partial block past its old end. Otherwise
+//    the stream is compressed to a temporary file, and the file is
+//    never touched.
+func (appender *BinAppender) AppendStreamReaderContext(ctx context.Context, name string, source io.Reader) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	gzWriter.Close()
+	_, err := appender.ReadFrom(name, withContext(ctx, source))
+	return err
+}
 
-	endPtr, err := appender.fileHandle.Seek(0, io.SeekEnd)
-	if err != nil {
-		return err
+//source, failing its reads with ctx.Err() once ctx is done
+func withContext(ctx context.Context, source io.Reader) io.Reader {
+	//Background and TODO contexts can never be cancelled
+	if ctx.Done() == nil {
+		return source
+	}
+	reader := &contextReader{ctx: ctx, reader: source}
+	//Keep seekable sources seekable, so they can still be stored
+	if seeker, seekable := source.(io.Seeker); seekable {
+		return &contextReadSeeker{contextReader: reader, Seeker: seeker}
 	}
+	return reader
+}
 
-	fileMetadata := appendedData{}
-	fileMetadata.StartFilePtr = startPtr
-	fileMetadata.ZippedSize = endPtr - startPtr
+//contextReader that can still be seeked
+type contextReadSeeker struct {
+	*contextReader
+	io.Seeker
+}
 
-	appender.metadata.Data[name] = fileMetadata
-	return nil
+// Procedure:
+//  BinAppender.AppendStreamReaderWithAttrs
+// Purpose:
+//  To append a stream along with key/value pairs describing it
+// Parameters:
+//  The parent *BinAppender: appender
+//  The unique name of the stream: name string
+//  The reader to pull data out of: source io.Reader
+//  What to record about the block: attrs map[string]string
+// Produces:
+//  Any errors in writing to the filesystem: err error
+// Preconditions:
+//  As for AppendStreamReader
+// Postconditions:
+//  As for AppendStreamReader
+//  A copy of attrs is stored with the block, for
+//    BinAppendExtractor.Attributes to read back
+func (appender *BinAppender) AppendStreamReaderWithAttrs(name string, source io.Reader, attrs map[string]string) error {
+	_, err := appender.appendStream(name, source, attrs, 0)
+	return err
 }
 
 // Procedure:
-//  BinAppender.AppendFile
+//  BinAppender.ReadFrom
 // Purpose:
-//  To gzip and pack a file onto the end of the BinAppender's file
+//  To append a stream as AppendStreamReader does, reporting how much was read
 // Parameters:
-//  The calling BinAppender: appender BinAppender
-//  The file to append: source string
+//  The parent *BinAppender: appender
+//  The unique name of the stream: name string
+//  The reader to pull data out of: source io.Reader
 // Produces:
-//  Side effects:
-//    filesystem
-//    internal state changes
+//  The number of uncompressed bytes read from source: n int64
 //  Any errors in writing to the filesystem: err error
 // Preconditions:
-//  $source exists and is readable in the file system
-//  $source has not been appended already nor has $appender.AppendStreamReader(name, _)
-//    been called with name == $source
-//  $appender.Close() has not been called
+//  As for AppendStreamReader
 // Postconditions:
-//  A reader stream from $source will be passed to $appender.AppendStreamReader,
-//    with the name parameter as source
-func (appender *BinAppender) AppendFile(source string) error {
-	sourceHandle, err := os.Open(source)
-	if err != nil {
-		return err
-	}
+//  As for AppendStreamReader
+//  n is 0 if err is non-nil
+func (appender *BinAppender) ReadFrom(name string, source io.Reader) (n int64, err error) {
+	fileMetadata, err := appender.appendStream(name, source, nil, 0)
+	return fileMetadata.UnzippedSize, err
+}
 
-	appender.mux.Lock()
-	if _, exists := appender.metadata.Data[source]; exists {
-		appender.mux.Unlock()
-		return errors.New(fmt.Sprintf("file %s has already been added to appender", source))
+//Compresses source and appends it under name with attrs and mode,
+//returning the block's metadata. attrs is copied, and both are recorded
+//along with the block, so Close never sees the block without them.
+//A mode of 0 records none.
+func (appender *BinAppender) appendStream(name string, source io.Reader, attrs map[string]string, mode os.FileMode) (appendedData, error) {
+	//Compressing straight into the file saves copying the block through
+	//a temporary file, but holds mux throughout, so it's only done when
+	//no other append is running. Appends that start meanwhile compress
+	//to temporary files, and wait for mux only to copy them in.
+	defer atomic.AddInt32(&appender.appending, -1)
+	if atomic.AddInt32(&appender.appending, 1) == 1 {
+		return appender.appendDirect(name, source, attrs, mode)
 	}
-	appender.mux.Unlock()
-
-	err = appender.AppendStreamReader(source, sourceHandle)
+	//Checked again when space is reserved, this just saves compressing
+	if err := appender.checkOpen(); err != nil {
+		return appendedData{}, err
+	}
+	compressed, fileMetadata, err := appender.compressToTemp(name, source)
 	if err != nil {
-		return err
+		return appendedData{}, err
 	}
-	return sourceHandle.Close()
+	defer func() {
+		_ = compressed.Close()
+		_ = os.Remove(compressed.Name())
+	}()
+	fileMetadata.Attributes = copyAttributes(attrs)
+	fileMetadata.Mode = mode
+	_, err = appender.appendTemp(name, compressed, fileMetadata)
+	if err != nil {
+		return appendedData{}, err
+	}
+	return fileMetadata, nil
 }
 
 // Procedure:
-//  BinAppender.Close()
+//  BinAppender.AppendStreamReaderHashed
 // Purpose:
-//  To finish writing to the file being appended to
-//    and free it for use elsewhere
+//  To append a stream and learn its hash without reading it twice
 // Parameters:
-//   The BinAppender being acted upon: appender
+//  The parent *BinAppender: appender
+//  The unique name of the stream: name string
+//  The reader to pull data out of: source io.Reader
 // Produces:
-//   Any filesystem errors: err error
+//  The hash of the uncompressed stream: hash []byte
+//  Any errors in writing to the filesystem: err error
 // Preconditions:
-//  $appender.Close() has not been called
+//  As for AppendStreamReader
 // Postconditions:
-//  The json-encoded metadata about the appended files has been
-//    written out to the end of file being appended to
-//  The start of said json block is encoded in the final 8 bytes of
-//    the file being appended to as a little endian int64
-//  The internal file handle for the file being appended to has been closed
-func (appender *BinAppender) Close() error {
+//  As for AppendStreamReader
+//  hash is computed with $appender.HashAlgo as the stream is
+//    compressed, and is the block's recorded checksum undone from hex
+//  hash covers the uncompressed bytes, so it doesn't change with
+//    the compression level, framing, or whether the block was stored
+//  hash is nil if $appender.HashAlgo is HashNone, or err is non-nil
+func (appender *BinAppender) AppendStreamReaderHashed(name string, source io.Reader) (hash []byte, err error) {
+	fileMetadata, err := appender.appendStream(name, source, nil, 0)
+	if err != nil || fileMetadata.Checksum == "" {
+		return nil, err
+	}
+	return hex.DecodeString(fileMetadata.Checksum)
+}
+
+//appendStream for when no other append is running, compressing source
+//straight onto the end of the file while holding mux
+func (appender *BinAppender) appendDirect(name string, source io.Reader, attrs map[string]string, mode os.FileMode) (appendedData, error) {
+	//Remember where a seekable source started in case it needs to be stored
+	seeker, seekable := source.(io.Seeker)
+	var sourceStart int64
+	var err error
+	if seekable {
+		sourceStart, err = seeker.Seek(0, io.SeekCurrent)
+		seekable = err == nil
+	}
+
 	appender.mux.Lock()
 	defer appender.mux.Unlock()
-
-	jsonPtr, err := appender.fileHandle.Seek(0, io.SeekEnd)
+	if appender.closed {
+		return appendedData{}, ErrAlreadyClosed
+	}
+	appender.waitIdle()
+	startPtr, err := appender.fileHandle.Seek(0, io.SeekEnd)
 	if err != nil {
-		return err
+		return appendedData{}, err
+	}
+	var destination io.Writer = appender.fileHandle
+	guard := appender.newSizeGuard(name, appender.fileHandle, startPtr)
+	if guard != nil {
+		destination = guard
+	}
+	writer, err := appender.newBlockWriter(name, destination, startPtr)
+	if err != nil {
+		return appendedData{}, err
+	}
+	if guard != nil && seekable {
+		guard.uncompressed = writer.counter
+	}
+	_, err = io.Copy(writer, source)
+	if err != nil {
+		writer.abort()
+		return appendedData{}, appender.truncateTo(startPtr, err)
+	}
+	fileMetadata, err := writer.finish()
+	if err != nil {
+		return appendedData{}, err
 	}
-	jsonPtrBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(jsonPtrBytes, uint64(jsonPtr))
 
-	jsonBytes, err := json.Marshal(appender.metadata)
-	//Should not happen
+	//As in compressToTemp, store data that gzip made bigger
+	if !fileMetadata.Stored && seekable && fileMetadata.ZippedSize >= fileMetadata.UnzippedSize {
+		err = appender.truncateTo(startPtr, nil)
+		if err == nil {
+			_, err = seeker.Seek(sourceStart, io.SeekStart)
+		}
+		var storedSize int64
+		if err == nil {
+			storedSize, err = io.Copy(appender.fileHandle, source)
+		}
+		if err != nil {
+			return appendedData{}, appender.truncateTo(startPtr, err)
+		}
+		fileMetadata.ZippedSize = storedSize
+		fileMetadata.UnzippedSize = storedSize
+		fileMetadata.Stored = true
+		fileMetadata.Framing = FramingGzip
+		fileMetadata.Dictionary = ""
+	}
+	err = appender.checkLimits(name, fileMetadata.ZippedSize, startPtr+fileMetadata.ZippedSize)
 	if err != nil {
-		return err
+		return appendedData{}, appender.truncateTo(startPtr, err)
 	}
-	_, err = appender.fileHandle.Write(jsonBytes)
+	fileMetadata.Attributes = copyAttributes(attrs)
+	fileMetadata.Mode = mode
+	appender.metadata.Data[name] = fileMetadata
+	return fileMetadata, nil
+}
+
+//Copies a block prepared in a temporary file onto the end of the
+//appender's file and records it under name, returning its UnzippedSize.
+//Other blocks may be copied in at the same time.
+func (appender *BinAppender) appendTemp(name string, compressed *os.File, fileMetadata appendedData) (int64, error) {
+	startPtr, err := appender.reserve(name, fileMetadata.ZippedSize)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	_, err = appender.fileHandle.Write(jsonPtrBytes)
+	_, err = compressed.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(&offsetWriter{file: appender.fileHandle, offset: startPtr}, compressed)
+	}
+
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	defer appender.release()
 	if err != nil {
-		return err
+		//Only the last reserved block can be cut off without
+		//disturbing the others
+		if startPtr+fileMetadata.ZippedSize == appender.endPtr {
+			appender.endPtr = startPtr
+			return 0, appender.truncateTo(startPtr, err)
+		}
+		return 0, err
 	}
-	return appender.fileHandle.Close()
+	fileMetadata.StartFilePtr = startPtr
+	appender.metadata.Data[name] = fileMetadata
+	return fileMetadata.UnzippedSize, nil
+}
+
+// Procedure:
+//  BinAppender.UseDictionary
+// Purpose:
+//  To compress blocks against a shared preset dictionary, which helps
+//    a lot with many small, similar blocks like config files
+// Parameters:
+//  The parent *BinAppender: appender
+//  Bytes typical of the blocks to come, nil to stop: dictionary []byte
+// Produces:
+//  Any errors storing the dictionary: err error
+// Preconditions:
+//  No appends are running
+//  appender.Framing is FramingZlib or FramingDeflate for the blocks
+//    appended with the dictionary; gzip can't use one
+// Postconditions:
+//  The dictionary is appended uncompressed once, as a block named
+//    dictionaryBlockPrefix followed by the start of its SHA-256, and
+//    later blocks record that name so extractors can find it
+//  Blocks appended after this are compressed with the dictionary,
+//    until UseDictionary is called again
+//  Only the last 32KiB of dictionary is used by the compressor
+func (appender *BinAppender) UseDictionary(dictionary []byte) error {
+	if dictionary == nil {
+		appender.mux.Lock()
+		defer appender.mux.Unlock()
+		appender.dictionary = nil
+		appender.dictionaryName = ""
+		return nil
+	}
+	hash := sha256.Sum256(dictionary)
+	name := dictionaryBlockPrefix + hex.EncodeToString(hash[:8])
+
+	appender.mux.Lock()
+	_, exists := appender.metadata.Data[name]
+	appender.mux.Unlock()
+	if !exists {
+		temp, err := ioutil.TempFile("", "transcodebot-block-")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = temp.Close()
+			_ = os.Remove(temp.Name())
+		}()
+		_, err = temp.Write(dictionary)
+		if err != nil {
+			return err
+		}
+		size := int64(len(dictionary))
+		fileMetadata := appendedData{ZippedSize: size, UnzippedSize: size, Stored: true}
+		hashAlgo := appender.hashAlgo()
+		hasher, err := hashAlgo.newHash()
+		if err != nil {
+			return err
+		}
+		if hasher != nil {
+			_, _ = hasher.Write(dictionary)
+			fileMetadata.Checksum = hexSum(hasher)
+			fileMetadata.HashAlgo = hashAlgo
+		}
+		_, err = appender.appendTemp(name, temp, fileMetadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	appender.dictionary = append([]byte{}, dictionary...)
+	appender.dictionaryName = name
+	return nil
+}
+
+// Procedure:
+//  BinAppender.AppendGzippedStream
+// Purpose:
+//  To append data that is already gzipped without compressing it again
+// Parameters:
+//  The parent *BinAppender: appender
+//  The unique name of the block: name string
+//  The gzipped stream: source io.Reader
+// Produces:
+//  Any errors in reading, checking, or writing: err error
+// Preconditions:
+//  As for AppendStreamReader
+// Postconditions:
+//  The bytes of source are appended as is, as a gzip block, so that
+//    extracting it strips that one layer of gzip
+//  source is decompressed along the way to check it and find its
+//    UnzippedSize; err is non-nil and nothing is appended if it
+//    doesn't start with the gzip magic number or doesn't decompress
+//  As for AppendStreamReader otherwise
+func (appender *BinAppender) AppendGzippedStream(name string, source io.Reader) error {
+	buffered := bufio.NewReader(source)
+	magic, err := buffered.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return errors.New(fmt.Sprintf("%s is not gzipped", name))
+	}
+
+	compressed, err := ioutil.TempFile("", "transcodebot-block-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = compressed.Close()
+		_ = os.Remove(compressed.Name())
+	}()
+
+	counter := &writeCounter{}
+	writers := []io.Writer{counter}
+	hashAlgo := appender.hashAlgo()
+	hasher, err := hashAlgo.newHash()
+	if err != nil {
+		return err
+	}
+	if hasher != nil {
+		writers = append(writers, hasher)
+	}
+	dump, err := appender.createDump(name)
+	if err != nil {
+		return err
+	}
+	if dump != nil {
+		defer func() { _ = dump.Close() }()
+		writers = append(writers, dump)
+	}
+	uncompressed := io.MultiWriter(writers...)
+	//The gzip reader reads every member through to the end of source,
+	//so the whole stream passes through to the temporary file
+	var destination io.Writer = compressed
+	guard, err := appender.newTempSizeGuard(name, compressed)
+	if err != nil {
+		return err
+	}
+	if guard != nil {
+		destination = guard
+	}
+	gzReader, err := gzip.NewReader(io.TeeReader(buffered, destination))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(uncompressed, gzReader)
+	if err != nil {
+		return err
+	}
+
+	var fileMetadata appendedData
+	fileMetadata.ZippedSize, err = compressed.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	fileMetadata.UnzippedSize = counter.count
+	fileMetadata.Framing = FramingGzip
+	if hasher != nil {
+		fileMetadata.Checksum = hexSum(hasher)
+		fileMetadata.HashAlgo = hashAlgo
+	}
+	_, err = appender.appendTemp(name, compressed, fileMetadata)
+	return err
+}
+
+// Procedure:
+//  BinAppender.compressToTemp
+// Purpose:
+//  To compress a stream into a temporary file, ready to be copied
+//    into the appender's file
+// Parameters:
+//  The parent *BinAppender: appender
+//  The name of the block: name string
+//  The reader to pull data out of: source io.Reader
+// Produces:
+//  The temporary file holding the block: compressed *os.File
+//  The block's metadata, without StartFilePtr: fileMetadata appendedData
+//  Any errors: err error
+// Preconditions:
+//  appender.mux is not needed
+// Postconditions:
+//  The caller closes and removes compressed
+//  If err is non-nil, no temporary file is left behind
+//  If gzip made the data bigger and source is an io.Seeker, the
+//    block is re-read and stored uncompressed
+func (appender *BinAppender) compressToTemp(name string, source io.Reader) (compressed *os.File, fileMetadata appendedData, err error) {
+	//Remember where a seekable source started in case it needs to be stored
+	seeker, seekable := source.(io.Seeker)
+	var sourceStart int64
+	if seekable {
+		sourceStart, err = seeker.Seek(0, io.SeekCurrent)
+		seekable = err == nil
+	}
+
+	compressed, err = ioutil.TempFile("", "transcodebot-block-")
+	if err != nil {
+		return nil, fileMetadata, err
+	}
+	fail := func(err error) (*os.File, appendedData, error) {
+		_ = compressed.Close()
+		_ = os.Remove(compressed.Name())
+		return nil, appendedData{}, err
+	}
+
+	var destination io.Writer = compressed
+	guard, err := appender.newTempSizeGuard(name, compressed)
+	if err != nil {
+		return fail(err)
+	}
+	if guard != nil {
+		destination = guard
+	}
+	writer, err := appender.newBlockWriter(name, destination, 0)
+	if err != nil {
+		return fail(err)
+	}
+	//Stored blocks are as big as the data, which may still fit
+	if guard != nil && seekable {
+		guard.uncompressed = writer.counter
+	}
+	_, err = io.Copy(writer, source)
+	if err != nil {
+		writer.abort()
+		return fail(err)
+	}
+	err = writer.close()
+	if err != nil {
+		return fail(err)
+	}
+	fileMetadata.ZippedSize, err = compressed.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fail(err)
+	}
+	fileMetadata.UnzippedSize = writer.counter.count
+	fileMetadata.Stored = writer.stored
+	fileMetadata.Framing = writer.framing
+	fileMetadata.Dictionary = writer.dictionaryName
+	writer.setChecksum(&fileMetadata)
+
+	//Already compressed data (video, zips) tends to grow when gzipped,
+	//so store it as is if the source can be read a second time
+	if !fileMetadata.Stored && seekable && fileMetadata.ZippedSize >= fileMetadata.UnzippedSize {
+		err = compressed.Truncate(0)
+		if err != nil {
+			return fail(err)
+		}
+		_, err = compressed.Seek(0, io.SeekStart)
+		if err != nil {
+			return fail(err)
+		}
+		_, err = seeker.Seek(sourceStart, io.SeekStart)
+		if err != nil {
+			return fail(err)
+		}
+		storedSize, err := io.Copy(compressed, source)
+		if err != nil {
+			return fail(err)
+		}
+		fileMetadata.ZippedSize = storedSize
+		fileMetadata.UnzippedSize = storedSize
+		fileMetadata.Stored = true
+		fileMetadata.Framing = FramingGzip
+		fileMetadata.Dictionary = ""
+	}
+	return compressed, fileMetadata, nil
+}
+
+//Writer in front of wherever a block is written that fails as soon as
+//the block is sure to break MaxBlockSize or MaxTotalSize, so an
+//oversized stream is stopped before it fills the file or the
+//temporary directory
+type sizeGuard struct {
+	name    string
+	writer  io.Writer
+	written int64
+	//Most the block can take up in the file
+	limit int64
+	//Uncompressed bytes so far, if the block could still be stored
+	//as is, which fits if the data does
+	uncompressed *writeCounter
+}
+
+func (guard *sizeGuard) Write(p []byte) (int, error) {
+	guard.written += int64(len(p))
+	if guard.written > guard.limit && (guard.uncompressed == nil || guard.uncompressed.count > guard.limit) {
+		return 0, errors.New(fmt.Sprintf("%s passed %d bytes packed, over the %d bytes MaxBlockSize and MaxTotalSize leave for it",
+			guard.name, guard.written, guard.limit))
+	}
+	return guard.writer.Write(p)
+}
+
+//A sizeGuard for the block name being written to writer, when the
+//file currently ends at end, nil if neither MaxBlockSize nor
+//MaxTotalSize is set
+func (appender *BinAppender) newSizeGuard(name string, writer io.Writer, end int64) *sizeGuard {
+	if appender.MaxBlockSize <= 0 && appender.MaxTotalSize <= 0 {
+		return nil
+	}
+	guard := &sizeGuard{name: name, writer: writer, limit: appender.MaxBlockSize}
+	if appender.MaxTotalSize > 0 {
+		room := appender.MaxTotalSize - end
+		if room < 0 {
+			room = 0
+		}
+		if guard.limit <= 0 || room < guard.limit {
+			guard.limit = room
+		}
+	}
+	return guard
+}
+
+//newSizeGuard for a block being compressed to a temporary file, where
+//the file's end can only be a guess. The final say is reserve's,
+//since other appends may finish first.
+func (appender *BinAppender) newTempSizeGuard(name string, writer io.Writer) (*sizeGuard, error) {
+	var end int64
+	if appender.MaxTotalSize > 0 {
+		appender.mux.Lock()
+		end = appender.endPtr
+		var err error
+		if appender.inFlight == 0 {
+			end, err = appender.fileHandle.Seek(0, io.SeekEnd)
+		}
+		appender.mux.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return appender.newSizeGuard(name, writer, end), nil
+}
+
+//Sets aside size bytes at the end of the file for the block name,
+//returning where they start. release must be called once the block is
+//written. Fails without reserving anything if the block is over
+//MaxBlockSize or would take the file over MaxTotalSize.
+func (appender *BinAppender) reserve(name string, size int64) (int64, error) {
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	if appender.closed {
+		return 0, ErrAlreadyClosed
+	}
+	//With nothing else reserved, the file itself says where the end is
+	if appender.inFlight == 0 {
+		end, err := appender.fileHandle.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		appender.endPtr = end
+	}
+	startPtr := appender.endPtr
+	if err := appender.checkLimits(name, size, startPtr+size); err != nil {
+		return 0, err
+	}
+	appender.endPtr += size
+	appender.inFlight++
+	return startPtr, nil
+}
+
+//Returns why the block name, size bytes packed and ending the file at
+//endPtr, is over $appender.MaxBlockSize or MaxTotalSize, nil if it isn't
+func (appender *BinAppender) checkLimits(name string, size int64, endPtr int64) error {
+	if appender.MaxBlockSize > 0 && size > appender.MaxBlockSize {
+		return errors.New(fmt.Sprintf("%s is %d bytes packed, over the MaxBlockSize of %d", name, size, appender.MaxBlockSize))
+	}
+	if appender.MaxTotalSize > 0 && endPtr > appender.MaxTotalSize {
+		return errors.New(fmt.Sprintf("appending %s would grow the file to %d bytes, over the MaxTotalSize of %d", name, endPtr, appender.MaxTotalSize))
+	}
+	return nil
+}
+
+//The hash to record checksums with, filling in the default
+func (appender *BinAppender) hashAlgo() HashAlgo {
+	if appender.HashAlgo == "" {
+		return HashCRC32
+	}
+	return appender.HashAlgo
+}
+
+//Returns ErrAlreadyClosed if appender has been closed
+func (appender *BinAppender) checkOpen() error {
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	if appender.closed {
+		return ErrAlreadyClosed
+	}
+	return nil
+}
+
+//Marks a reserved block as written
+//appender.mux must be held by the caller
+func (appender *BinAppender) release() {
+	appender.inFlight--
+	appender.idle.Broadcast()
+}
+
+//Waits until every reserved block has been written, so the end of
+//the file is the end of the last block
+//appender.mux must be held by the caller
+func (appender *BinAppender) waitIdle() {
+	for appender.inFlight > 0 {
+		appender.idle.Wait()
+	}
+}
+
+//Writes sequentially to file starting at offset, without moving
+//the file's own position, so several can write to one file at once
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (writer *offsetWriter) Write(p []byte) (int, error) {
+	n, err := writer.file.WriteAt(p, writer.offset)
+	writer.offset += int64(n)
+	return n, err
+}
+
+// Type:
+//  blockWriter
+// Purpose:
+//  To gzip everything written to it into a single block
+//  at the end of a BinAppender's file
+// Explicitly implements:
+//  io.Writer
+// Postconditions:
+//  finish must be called to get the block's metadata
+type blockWriter struct {
+	appender *BinAppender
+	startPtr int64
+	counter  *writeCounter
+	//A *gzip.Writer, a *parallelGzipWriter, a *zlib.Writer,
+	//a *flate.Writer, or a *storeWriter
+	gzWriter flushWriteCloser
+	//gzWriter is a storeWriter, so the block is not compressed
+	stored bool
+	//Framing written by gzWriter, if it isn't a storeWriter
+	framing Framing
+	//Block holding the dictionary gzWriter was primed with, if any
+	dictionaryName string
+	//Between gzWriter and the file, nil if buffering is off
+	buffer *bufio.Writer
+	//Gets a copy of everything written, nil unless DebugDumpDir is set
+	dump *os.File
+	//Hashes everything written, nil if the appender records no checksums
+	hasher   hash.Hash
+	hashAlgo HashAlgo
+}
+
+//Compressing writer that can push out what it has so far
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Procedure:
+//  BinAppender.startBlock
+// Purpose:
+//  To start a new block at the end of the appender's file
+// Parameters:
+//  The parent *BinAppender: appender
+//  The name of the block: name string
+// Produces:
+//  A writer for the block: writer *blockWriter
+//  Any errors seeking to the end of the file: err error
+// Preconditions:
+//  appender.mux is held by the caller until writer is finished
+// Postconditions:
+//  writer will write gzipped data starting at the current end of the file
+//  writer fails as soon as the block is sure to break MaxBlockSize or
+//    MaxTotalSize
+func (appender *BinAppender) startBlock(name string) (*blockWriter, error) {
+	if appender.closed {
+		return nil, ErrAlreadyClosed
+	}
+	appender.waitIdle()
+	startPtr, err := appender.fileHandle.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	var destination io.Writer = appender.fileHandle
+	if guard := appender.newSizeGuard(name, appender.fileHandle, startPtr); guard != nil {
+		destination = guard
+	}
+	return appender.newBlockWriter(name, destination, startPtr)
+}
+
+//Creates the DebugDumpDir file for the block name, nil if dumps are off
+func (appender *BinAppender) createDump(name string) (*os.File, error) {
+	if appender.DebugDumpDir == "" {
+		return nil, nil
+	}
+	return os.Create(filepath.Join(appender.DebugDumpDir, url.PathEscape(name)))
+}
+
+//Creates a blockWriter compressing into destination, set up according
+//to the appender's compression, buffering, and debug dump settings
+func (appender *BinAppender) newBlockWriter(name string, destination io.Writer, startPtr int64) (*blockWriter, error) {
+	writer := &blockWriter{
+		appender: appender,
+		startPtr: startPtr,
+		counter:  &writeCounter{},
+	}
+	var err error
+	writer.hashAlgo = appender.hashAlgo()
+	writer.hasher, err = writer.hashAlgo.newHash()
+	if err != nil {
+		return nil, err
+	}
+	dump, err := appender.createDump(name)
+	if err != nil {
+		return nil, err
+	}
+	writer.dump = dump
+	if appender.WriteBufferSize >= 0 {
+		bufferSize := appender.WriteBufferSize
+		if bufferSize == 0 {
+			bufferSize = defaultWriteBufferSize
+		}
+		writer.buffer = bufio.NewWriterSize(destination, bufferSize)
+		destination = writer.buffer
+	}
+	dictionary := appender.dictionary
+	switch {
+	case appender.FastPack:
+		writer.gzWriter = &storeWriter{destination: destination}
+		writer.stored = true
+	case appender.Framing == FramingZlib:
+		//Only fails for invalid levels
+		writer.gzWriter, _ = zlib.NewWriterLevelDict(destination, zlib.DefaultCompression, dictionary)
+	case appender.Framing == FramingDeflate:
+		writer.gzWriter, _ = flate.NewWriterDict(destination, flate.DefaultCompression, dictionary)
+	case appender.Framing != FramingGzip:
+		writer.abort()
+		return nil, errors.New(fmt.Sprintf("unknown framing %q", appender.Framing))
+	case dictionary != nil:
+		writer.abort()
+		return nil, errors.New("gzip can't use a dictionary, use zlib or deflate framing")
+	case appender.ParallelCompress:
+		writer.gzWriter = newParallelGzipWriter(destination, appender.CompressWorkers)
+	default:
+		writer.gzWriter = gzip.NewWriter(destination)
+	}
+	if !writer.stored {
+		writer.framing = appender.Framing
+		if dictionary != nil {
+			writer.dictionaryName = appender.dictionaryName
+		}
+	}
+	return writer, nil
+}
+
+func (writer *blockWriter) Write(p []byte) (int, error) {
+	_, _ = writer.counter.Write(p)
+	if writer.hasher != nil {
+		_, _ = writer.hasher.Write(p)
+	}
+	n, err := writer.gzWriter.Write(p)
+	if writer.dump != nil && n > 0 {
+		_, dumpErr := writer.dump.Write(p[:n])
+		if err == nil {
+			err = dumpErr
+		}
+	}
+	return n, err
+}
+
+//Pushes everything written to the block so far out to the file
+func (writer *blockWriter) flush() error {
+	err := writer.gzWriter.Flush()
+	if err != nil || writer.buffer == nil {
+		return err
+	}
+	return writer.buffer.Flush()
+}
+
+//Finishes the compressed stream and pushes it all out of the buffer
+func (writer *blockWriter) close() error {
+	err := writer.gzWriter.Close()
+	if err == nil && writer.buffer != nil {
+		err = writer.buffer.Flush()
+	}
+	if writer.dump != nil {
+		dumpErr := writer.dump.Close()
+		if err == nil {
+			err = dumpErr
+		}
+	}
+	return err
+}
+
+//Stops the compressor and closes the dump when the block is being
+//thrown away. Whatever was dumped is left for inspection.
+func (writer *blockWriter) abort() {
+	if writer.gzWriter != nil {
+		_ = writer.gzWriter.Close()
+	}
+	if writer.dump != nil {
+		_ = writer.dump.Close()
+	}
+}
+
+// Procedure:
+//  *blockWriter.finish
+// Purpose:
+//  To flush the end of the block out to the file
+// Parameters:
+//  The *blockWriter being finished: writer
+// Produces:
+//  The metadata describing the block: fileMetadata appendedData
+//  Any filesystem errors: err error
+// Preconditions:
+//  finish has not been called on writer
+// Postconditions:
+//  If err is non-nil, the file is truncated back to where the block started
+func (writer *blockWriter) finish() (fileMetadata appendedData, err error) {
+	err = writer.close()
+	if err != nil {
+		return fileMetadata, writer.appender.truncateTo(writer.startPtr, err)
+	}
+	endPtr, err := writer.appender.fileHandle.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fileMetadata, writer.appender.truncateTo(writer.startPtr, err)
+	}
+	fileMetadata.StartFilePtr = writer.startPtr
+	fileMetadata.ZippedSize = endPtr - writer.startPtr
+	fileMetadata.UnzippedSize = writer.counter.count
+	fileMetadata.Stored = writer.stored
+	fileMetadata.Framing = writer.framing
+	fileMetadata.Dictionary = writer.dictionaryName
+	writer.setChecksum(&fileMetadata)
+	return fileMetadata, nil
+}
+
+//Records the hash of everything written in fileMetadata, if there is one
+func (writer *blockWriter) setChecksum(fileMetadata *appendedData) {
+	if writer.hasher != nil {
+		fileMetadata.Checksum = hexSum(writer.hasher)
+		fileMetadata.HashAlgo = writer.hashAlgo
+	}
+}
+
+//Passes writes straight through, for blocks that aren't compressed
+type storeWriter struct {
+	destination io.Writer
+}
+
+func (writer *storeWriter) Write(p []byte) (int, error) {
+	return writer.destination.Write(p)
+}
+
+func (writer *storeWriter) Flush() error {
+	return nil
+}
+
+func (writer *storeWriter) Close() error {
+	return nil
+}
+
+// Type:
+//  AppendWriter
+// Purpose:
+//  Generated by BinAppender.AppendWriter to push data into a block
+// Explicitly implements:
+//  io.Writer
+//  io.Closer
+//  io.WriteCloser
+// Postconditions:
+//  Must be closed to record the block and free up the BinAppender
+type AppendWriter struct {
+	name   string
+	writer *blockWriter
+	//First error from Write, the block is thrown away on Close if set
+	err    error
+	closed bool
+}
+
+// Procedure:
+//  BinAppender.AppendWriter
+// Purpose:
+//  To append a block by writing to it rather than handing over a reader
+// Parameters:
+//  The parent *BinAppender: appender
+//  The unique name of the block: name string
+// Produces:
+//  A writer for the block: writer *AppendWriter
+//  Any errors in seeking in the file: err error
+// Preconditions:
+//  $appender.Close() has not been called
+// Postconditions:
+//  Everything written to writer is gzipped onto the end of the file
+//  The block is recorded under $name when writer is closed
+//  Until writer is closed, all other calls on appender block,
+//    including AppendWriter. Only one may be open at a time.
+//  Writes fail as soon as the block is sure to break
+//    $appender.MaxBlockSize or $appender.MaxTotalSize
+func (appender *BinAppender) AppendWriter(name string) (*AppendWriter, error) {
+	appender.mux.Lock()
+	writer, err := appender.startBlock(name)
+	if err != nil {
+		appender.mux.Unlock()
+		return nil, err
+	}
+	return &AppendWriter{name: name, writer: writer}, nil
+}
+
+// Procedure:
+//  *AppendWriter.Write
+// Purpose:
+//  To add bytes to the block
+// Parameters:
+//  The *AppendWriter being written to: writer
+//  The bytes to write: p []byte
+// Produces:
+//  The number of bytes written: n int
+//  Any errors in writing: err error
+// Preconditions:
+//  writer has not been closed
+// Postconditions:
+//  See the documentation for io.Writer
+//  After any error, the block will be discarded when writer is closed
+func (writer *AppendWriter) Write(p []byte) (n int, err error) {
+	if writer.closed {
+		return 0, errors.New("write to closed AppendWriter")
+	}
+	if writer.err != nil {
+		return 0, writer.err
+	}
+	n, err = writer.writer.Write(p)
+	if err != nil {
+		writer.err = err
+	}
+	return n, err
+}
+
+// Procedure:
+//  *AppendWriter.ReadFrom
+// Purpose:
+//  To add everything from a reader to the block, so that io.Copy
+//    and os/exec hand data straight to the block
+// Parameters:
+//  The *AppendWriter being written to: writer
+//  The reader to pull data out of: source io.Reader
+// Produces:
+//  The number of bytes read from source: n int64
+//  Any errors in reading or writing: err error
+// Preconditions:
+//  writer has not been closed
+// Postconditions:
+//  See the documentation for io.ReaderFrom
+//  After any error, the block will be discarded when writer is closed
+func (writer *AppendWriter) ReadFrom(source io.Reader) (n int64, err error) {
+	if writer.closed {
+		return 0, errors.New("write to closed AppendWriter")
+	}
+	if writer.err != nil {
+		return 0, writer.err
+	}
+	n, err = io.Copy(writer.writer, source)
+	if err != nil {
+		writer.err = err
+	}
+	return n, err
+}
+
+// Procedure:
+//  *AppendWriter.Sync
+// Purpose:
+//  To make everything written to the block so far durable
+//    without finishing the block
+// Parameters:
+//  The *AppendWriter being synced: writer
+// Produces:
+//  Any errors in compressing or syncing: err error
+// Preconditions:
+//  writer has not been closed
+// Postconditions:
+//  The compressed data so far is flushed and synced to disk
+//  The block is still only recorded once writer is closed
+func (writer *AppendWriter) Sync() error {
+	if writer.closed {
+		return errors.New("sync of closed AppendWriter")
+	}
+	if writer.err != nil {
+		return writer.err
+	}
+	err := writer.writer.flush()
+	if err != nil {
+		writer.err = err
+		return err
+	}
+	return writer.writer.appender.fileHandle.Sync()
+}
+
+// Procedure:
+//  *AppendWriter.Close
+// Purpose:
+//  To finish the block and record it in the appender's metadata
+// Parameters:
+//  The *AppendWriter being closed: writer
+// Produces:
+//  Any errors from writing the block: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  The block is recorded under the writer's name, or if any write
+//    failed, the file is truncated back to before the block
+//  The parent BinAppender is unlocked
+//  Calling Close more than once does nothing
+func (writer *AppendWriter) Close() error {
+	if writer.closed {
+		return nil
+	}
+	writer.closed = true
+	appender := writer.writer.appender
+	defer appender.mux.Unlock()
+
+	if writer.err != nil {
+		writer.writer.abort()
+		return appender.truncateTo(writer.writer.startPtr, writer.err)
+	}
+	fileMetadata, err := writer.writer.finish()
+	if err != nil {
+		return err
+	}
+	err = appender.checkLimits(writer.name, fileMetadata.ZippedSize, fileMetadata.StartFilePtr+fileMetadata.ZippedSize)
+	if err != nil {
+		return appender.truncateTo(writer.writer.startPtr, err)
+	}
+	appender.metadata.Data[writer.name] = fileMetadata
+	return nil
+}
+
+// Procedure:
+//  BinAppender.ReserveBlock
+// Purpose:
+//  To let the caller write a block's bytes themselves, e.g. with an
+//    encoder the appender doesn't know about
+// Parameters:
+//  The parent *BinAppender: appender
+//  The unique name of the block: name string
+//  What writes the block: write func(w io.Writer) error
+// Produces:
+//  Any errors from write or the filesystem: err error
+// Preconditions:
+//  $appender.Close() has not been called
+//  write does not call any methods of appender
+// Postconditions:
+//  Everything write writes to w goes onto the end of the file untouched,
+//    and is recorded under $name with FramingCustom, so extractors
+//    hand it back exactly as written
+//  The unencoded size isn't known, so UnzippedSize is left 0
+//  The checksum, if any, is of the bytes as written
+//  appender.mux is held for the whole of write, so nothing else is
+//    appended in the middle of the block
+//  If write returns an error, the file is truncated back to before
+//    the block and nothing is recorded
+//  Writes to w fail as soon as they would take the block over
+//    $appender.MaxBlockSize or the file over $appender.MaxTotalSize
+func (appender *BinAppender) ReserveBlock(name string, write func(w io.Writer) error) error {
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	if appender.closed {
+		return ErrAlreadyClosed
+	}
+	appender.waitIdle()
+	startPtr, err := appender.fileHandle.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	hashAlgo := appender.hashAlgo()
+	hasher, err := hashAlgo.newHash()
+	if err != nil {
+		return err
+	}
+	writer := &offsetWriter{file: appender.fileHandle, offset: startPtr}
+	var destination io.Writer = writer
+	if guard := appender.newSizeGuard(name, writer, startPtr); guard != nil {
+		destination = guard
+	}
+	//Custom blocks are read back as written, so that's what is hashed
+	if hasher != nil {
+		destination = io.MultiWriter(destination, hasher)
+	}
+	if err = write(destination); err != nil {
+		return appender.truncateTo(startPtr, err)
+	}
+	if err = appender.checkLimits(name, writer.offset-startPtr, writer.offset); err != nil {
+		return appender.truncateTo(startPtr, err)
+	}
+	fileMetadata := appendedData{
+		StartFilePtr: startPtr,
+		ZippedSize:   writer.offset - startPtr,
+		Framing:      FramingCustom,
+	}
+	if hasher != nil {
+		fileMetadata.Checksum = hexSum(hasher)
+		fileMetadata.HashAlgo = hashAlgo
+	}
+	appender.metadata.Data[name] = fileMetadata
+	return nil
+}
+
+// Procedure:
+//  BinAppender.Sync
+// Purpose:
+//  To checkpoint the appended blocks to disk without closing
+// Parameters:
+//  The parent *BinAppender: appender
+// Produces:
+//  Any errors syncing the file: err error
+// Preconditions:
+//  $appender.Close() has not been called
+// Postconditions:
+//  Every finished block is synced to disk
+//  Waits for blocks being copied into the file and for any open
+//    AppendWriter; use AppendWriter.Sync to checkpoint from inside one.
+//    Appends still compressing are not waited for.
+//  The metadata trailer is still only written by Close
+func (appender *BinAppender) Sync() error {
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	if appender.closed {
+		return ErrAlreadyClosed
+	}
+	appender.waitIdle()
+	return appender.fileHandle.Sync()
+}
+
+// Procedure:
+//  BinAppender.truncateTo
+// Purpose:
+//  To throw away a partially written block after a failed append
+// Parameters:
+//  The parent *BinAppender: appender
+//  The length to cut the file back to: length int64
+//  The error that caused the append to fail: cause error
+// Produces:
+//  cause, or an error describing both cause and a failed truncation
+//  cause may be nil to truncate without an error
+// Preconditions:
+//  appender.mux is held by the caller
+//  length is the length of the file before the failed append started
+// Postconditions:
+//  The file being appended to is $length bytes long and its offset is at the end
+func (appender *BinAppender) truncateTo(length int64, cause error) error {
+	err := appender.fileHandle.Truncate(length)
+	if err == nil {
+		_, err = appender.fileHandle.Seek(length, io.SeekStart)
+	}
+	if err != nil && cause != nil {
+		return errors.New(fmt.Sprintf("%s; truncating back to %d bytes also failed: %s", cause, length, err))
+	} else if err != nil {
+		return err
+	}
+	return cause
+}
+
+// Procedure:
+//  BinAppender.AppendFile
+// Purpose:
+//  To gzip and pack a file onto the end of the BinAppender's file
+// Parameters:
+//  The calling BinAppender: appender BinAppender
+//  The file to append: source string
+// Produces:
+//  Side effects:
+//    filesystem
+//    internal state changes
+//  Any errors in writing to the filesystem: err error
+// Preconditions:
+//  As for AppendNamedFile with name == $source
+// Postconditions:
+//  As for AppendNamedFile with name == $source
+func (appender *BinAppender) AppendFile(source string) error {
+	return appender.AppendNamedFile(source, source)
+}
+
+// Procedure:
+//  BinAppender.AppendNamedFile
+// Purpose:
+//  To gzip and pack a file onto the end of the BinAppender's file
+//    under a name other than its path
+// Parameters:
+//  The calling BinAppender: appender BinAppender
+//  The unique name of the block: name string
+//  The file to append: source string
+// Produces:
+//  Side effects:
+//    filesystem
+//    internal state changes
+//  Any errors in writing to the filesystem: err error
+// Preconditions:
+//  $source exists and is readable in the file system
+//  $source is not the file being appended to, including through links
+//  Nothing has been appended under $name already
+//  $appender.Close() has not been called
+// Postconditions:
+//  A reader stream from $source is appended as by $appender.AppendStreamReader,
+//    with the name parameter as name
+//  The permission bits of $source are recorded along with the block, so
+//    that ExtractToFile can restore them. Symlinks are followed.
+//  If $name is already taken, $appender.OnDuplicate decides whether
+//    this fails, replaces the old block, or does nothing
+func (appender *BinAppender) AppendNamedFile(name string, source string) error {
+	return appender.AppendNamedFileContext(context.Background(), name, source)
+}
+
+//AppendNamedFile, reading source through AppendStreamReaderContext
+func (appender *BinAppender) AppendNamedFileContext(ctx context.Context, name string, source string) error {
+	if err := appender.checkOpen(); err != nil {
+		return err
+	}
+	sourceHandle, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = sourceHandle.Close() }()
+	info, err := sourceHandle.Stat()
+	if err != nil {
+		return err
+	}
+	//Reading the file being appended to would chase its own growing tail
+	appendeeInfo, err := appender.fileHandle.Stat()
+	if err != nil {
+		return err
+	}
+	if os.SameFile(info, appendeeInfo) {
+		return errors.New(fmt.Sprintf("cannot append %s to itself", source))
+	}
+
+	skip, err := appender.checkDuplicate(name)
+	if skip || err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	_, err = appender.appendStream(name, withContext(ctx, sourceHandle), nil, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return sourceHandle.Close()
+}
+
+//Applies $appender.OnDuplicate to name, giving whether to append nothing
+func (appender *BinAppender) checkDuplicate(name string) (skip bool, err error) {
+	appender.mux.Lock()
+	_, exists := appender.metadata.Data[name]
+	appender.mux.Unlock()
+	if !exists {
+		return false, nil
+	}
+	switch appender.OnDuplicate {
+	case DuplicateSkip:
+		return true, nil
+	case DuplicateReplace:
+		//AppendStreamReader overwrites the entry
+		return false, nil
+	default:
+		return false, errors.New(fmt.Sprintf("%s has already been added to appender", name))
+	}
+}
+
+// Procedure:
+//  BinAppender.AppendURL
+// Purpose:
+//  To download something straight into a block
+// Parameters:
+//  The calling BinAppender: appender BinAppender
+//  The unique name of the block: name string
+//  What to download: url string
+//  The client to download with: client *http.Client
+// Produces:
+//  Any errors in downloading or appending: err error
+// Preconditions:
+//  $appender.Close() has not been called
+// Postconditions:
+//  The response body is appended as with AppendStreamReader
+//  err is non-nil, and nothing is appended, if the response isn't
+//    200 OK or the body is shorter or longer than its Content-Length
+//  client's timeout and transport are used as is; a nil client
+//    means http.DefaultClient
+func (appender *BinAppender) AppendURL(name string, url string, client *http.Client) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("downloading %s: %s", url, response.Status))
+	}
+
+	var body io.Reader = response.Body
+	//-1 if unknown, or if the transport is decompressing it
+	if response.ContentLength >= 0 {
+		body = &lengthCheckingReader{reader: response.Body, remaining: response.ContentLength}
+	}
+	return appender.AppendStreamReader(name, body)
+}
+
+//Fails at EOF unless exactly remaining bytes were read
+type lengthCheckingReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (reader *lengthCheckingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.remaining -= int64(n)
+	if reader.remaining < 0 {
+		return n, errors.New("body is longer than its Content-Length")
+	}
+	if err == io.EOF && reader.remaining != 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Procedure:
+//  BinAppender.AppendFiles
+// Purpose:
+//  To append several files, all or nothing
+// Parameters:
+//  The calling BinAppender: appender BinAppender
+//  The files to append: sources []string
+// Produces:
+//  The first error in appending: err error
+// Preconditions:
+//  As for AppendFile, for every file in sources
+//  Nothing else appends to $appender until this returns; blocks
+//    appended alongside it would be thrown away with it on error
+// Postconditions:
+//  Either every file in sources is appended as with AppendFile, or
+//    err is non-nil and the file and metadata are back to how they
+//    were before the call
+func (appender *BinAppender) AppendFiles(sources []string) error {
+	return appender.AppendFilesContext(context.Background(), sources)
+}
+
+//AppendFiles, stopping and rolling back everything once ctx is done
+func (appender *BinAppender) AppendFilesContext(ctx context.Context, sources []string) error {
+	appender.mux.Lock()
+	if appender.closed {
+		appender.mux.Unlock()
+		return ErrAlreadyClosed
+	}
+	appender.waitIdle()
+	startLength, err := appender.fileHandle.Seek(0, io.SeekEnd)
+	if err != nil {
+		appender.mux.Unlock()
+		return err
+	}
+	snapshot := make(map[string]appendedData, len(appender.metadata.Data))
+	for name, data := range appender.metadata.Data {
+		snapshot[name] = data
+	}
+	appender.mux.Unlock()
+
+	for _, source := range sources {
+		err = appender.AppendNamedFileContext(ctx, source, source)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	appender.waitIdle()
+	appender.metadata.Data = snapshot
+	return appender.truncateTo(startLength, err)
+}
+
+// Procedure:
+//  BinAppender.AppendDir
+// Purpose:
+//  To pack every file under a directory
+// Parameters:
+//  The calling BinAppender: appender BinAppender
+//  The directory to pack: dir string
+//  What to start each block's name with: prefix string
+// Produces:
+//  Any errors in walking the directory or appending: err error
+// Preconditions:
+//  $appender.Close() has not been called
+// Postconditions:
+//  As for AppendDirFiltered with no includes or excludes
+func (appender *BinAppender) AppendDir(dir string, prefix string) error {
+	return appender.AppendDirFilteredContext(context.Background(), dir, prefix, nil, nil)
+}
+
+//AppendDir, stopping once ctx is done
+func (appender *BinAppender) AppendDirContext(ctx context.Context, dir string, prefix string) error {
+	return appender.AppendDirFilteredContext(ctx, dir, prefix, nil, nil)
+}
+
+// Procedure:
+//  BinAppender.AppendDirFiltered
+// Purpose:
+//  To pack the files under a directory that match a filter
+// Parameters:
+//  The calling BinAppender: appender BinAppender
+//  The directory to pack: dir string
+//  What to start each block's name with: prefix string
+//  Globs of the only files to pack, nil for all: includes []string
+//  Globs of files and directories to skip: excludes []string
+// Produces:
+//  Any errors in the patterns, walking the directory, or appending: err error
+// Preconditions:
+//  $appender.Close() has not been called
+// Postconditions:
+//  Each regular file under $dir is appended as with AppendNamedFile,
+//    named $prefix/ followed by its path relative to $dir, with
+//    forward slashes on every platform. With no prefix, the name is
+//    just the relative path.
+//  Patterns use path.Match syntax and are matched against both the
+//    forward slash relative path and its last element, so .git and
+//    *.tmp match at any depth while sub/*.tmp only matches in sub
+//  A file is skipped if it matches any exclude, or if there are
+//    includes and it matches none of them. Excluded directories
+//    aren't walked at all; includes only apply to files.
+//  Directories are walked in lexical order; symlinks are followed to
+//    files but not to directories
+//  The file being appended to is skipped if it is under $dir
+//  err is non-nil before anything is appended if a pattern is malformed
+//  Appending stops at the first error, leaving earlier files appended
+func (appender *BinAppender) AppendDirFiltered(dir string, prefix string, includes []string, excludes []string) error {
+	return appender.AppendDirFilteredContext(context.Background(), dir, prefix, includes, excludes)
+}
+
+// Procedure:
+//  BinAppender.AppendDirFilteredContext
+// Purpose:
+//  To pack a directory as AppendDirFiltered does, stopping if ctx is done
+// Parameters:
+//  As for AppendDirFiltered, plus
+//  The context bounding the append: ctx context.Context
+// Produces:
+//  Any errors in the patterns, walking the directory, or appending,
+//    or ctx.Err(): err error
+// Preconditions:
+//  As for AppendDirFiltered
+// Postconditions:
+//  As for AppendDirFiltered
+//  Once ctx is done, the file being read stops as for
+//    AppendStreamReaderContext, and no more files are started. Files
+//    already appended are kept, so Close still gives a usable file.
+func (appender *BinAppender) AppendDirFilteredContext(ctx context.Context, dir string, prefix string, includes []string, excludes []string) error {
+	for _, pattern := range append(append([]string{}, includes...), excludes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New(fmt.Sprintf("bad pattern %q: %s", pattern, err))
+		}
+	}
+	if err := appender.checkOpen(); err != nil {
+		return err
+	}
+	appendeeInfo, err := appender.fileHandle.Stat()
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(source string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(dir, source)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		if info.IsDir() {
+			if relative != "." && matchesAny(excludes, relative) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matchesAny(excludes, relative) || (len(includes) != 0 && !matchesAny(includes, relative)) {
+			return nil
+		}
+		//Walk doesn't follow symlinks, so look at what they point to
+		info, err = os.Stat(source)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || os.SameFile(info, appendeeInfo) {
+			return nil
+		}
+		return appender.AppendNamedFileContext(ctx, path.Join(prefix, relative), source)
+	})
+}
+
+//Whether a forward slash relative path or its last element matches any
+//of patterns, which have already been checked for errors
+func matchesAny(patterns []string, relative string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, relative); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(relative)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+//Block attributes AppendTar records from each member's header
+const (
+	//Permission bits, in octal
+	TarModeAttribute = "mode"
+	//Modification time, in RFC 3339
+	TarModTimeAttribute = "modtime"
+)
+
+// Procedure:
+//  BinAppender.AppendTar
+// Purpose:
+//  To pack each file in a tar stream as its own block
+// Parameters:
+//  The calling BinAppender: appender BinAppender
+//  The uncompressed tar stream: source io.Reader
+// Produces:
+//  Any errors in reading the tar or appending: err error
+// Preconditions:
+//  $appender.Close() has not been called
+// Postconditions:
+//  Each regular file in $source is appended as with
+//    AppendStreamReaderWithAttrs, named by its header name with any
+//    leading ./ or / removed, with TarModeAttribute and
+//    TarModTimeAttribute set from its header, and its permission
+//    bits recorded as the block's Mode
+//  Directories are skipped. Other members, e.g. symlinks, are skipped
+//    too, unless $appender.RejectTarSpecialFiles, in which case err is
+//    non-nil on the first one.
+//  Names already in the index are handled as $appender.OnDuplicate says
+//  Appending stops at the first error, leaving earlier files appended
+func (appender *BinAppender) AppendTar(source io.Reader) error {
+	if err := appender.checkOpen(); err != nil {
+		return err
+	}
+	tarReader := tar.NewReader(source)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("reading tar: %s", err))
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeDir:
+			continue
+		default:
+			if appender.RejectTarSpecialFiles {
+				return errors.New(fmt.Sprintf("tar member %s is not a regular file", header.Name))
+			}
+			continue
+		}
+		name := strings.TrimLeft(path.Clean("/" + header.Name), "/")
+		if name == "" {
+			return errors.New(fmt.Sprintf("tar member %q has no usable name", header.Name))
+		}
+		attrs := map[string]string{
+			TarModeAttribute:    strconv.FormatInt(header.Mode & 07777, 8),
+			TarModTimeAttribute: header.ModTime.UTC().Format(time.RFC3339),
+		}
+		skip, err := appender.checkDuplicate(name)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		//Recorded as the block's Mode too, so ExtractToFile uses it
+		//rather than guessing
+		mode := os.FileMode(header.Mode).Perm()
+		if _, err = appender.appendStream(name, tarReader, attrs, mode); err != nil {
+			return err
+		}
+	}
+}
+
+// Procedure:
+//  EstimatePackedSize
+// Purpose:
+//  To find roughly how much packing files would add to a binary,
+//    without touching the binary, e.g. to stay under a size cap
+// Parameters:
+//  The files to pack, named by their paths as AppendFiles does: paths []string
+// Produces:
+//  How many bytes the blocks and index would add: size int64
+//  Any errors reading the files: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  Each file is gzipped into nothing, with the default BinAppender
+//    settings, and the smaller of that and the file's own size counted,
+//    as AppendFile stores blocks that don't compress
+//  The index is estimated by encoding entries for every file, so the
+//    total may be off by a few bytes from what Close writes
+//  Takes as long as packing, since everything has to be compressed
+func EstimatePackedSize(paths []string) (size int64, err error) {
+	metadata := appendedMetadata{Version: MetadataVersion, Data: make(map[string]appendedData)}
+	for _, source := range paths {
+		sourceHandle, err := os.Open(source)
+		if err != nil {
+			return 0, err
+		}
+		info, err := sourceHandle.Stat()
+		if err != nil {
+			_ = sourceHandle.Close()
+			return 0, err
+		}
+		counter := &writeCounter{}
+		hasher, _ := HashCRC32.newHash()
+		gzWriter := gzip.NewWriter(counter)
+		unzippedSize, err := io.Copy(io.MultiWriter(gzWriter, hasher), sourceHandle)
+		_ = sourceHandle.Close()
+		if err == nil {
+			err = gzWriter.Close()
+		}
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("compressing %s: %s", source, err))
+		}
+		data := appendedData{
+			StartFilePtr: size,
+			ZippedSize:   counter.count,
+			UnzippedSize: unzippedSize,
+			Mode:         info.Mode(),
+			Checksum:     hexSum(hasher),
+			HashAlgo:     HashCRC32,
+		}
+		if unzippedSize <= counter.count {
+			data.ZippedSize = unzippedSize
+			data.Stored = true
+		}
+		metadata.Data[source] = data
+		size += data.ZippedSize
+	}
+	indexBytes, err := json.Marshal(metadata)
+	//Should not happen
+	if err != nil {
+		return 0, err
+	}
+	return size + int64(len(indexBytes)) + indexChecksumSize + trailerFlagsSize + indexPtrSize, nil
+}
+
+// Procedure:
+//  BinAppender.Close()
+// Purpose:
+//  To finish writing to the file being appended to
+//    and free it for use elsewhere
+// Parameters:
+//   The BinAppender being acted upon: appender
+// Produces:
+//   Any filesystem errors: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  If Close or FinalizeAtomic already succeeded, nothing is written
+//    and err is ErrAlreadyClosed
+//  The index of the appended files has been written out to the end
+//    of file being appended to, json-encoded unless $appender.BinaryIndex
+//    and gzipped if $appender.CompressIndex
+//  The index is followed by its crc32, then trailerMagic and a byte
+//    giving the index format and that the checksum is present
+//  The start of the index is encoded in the final 8 bytes of
+//    the file being appended to as a little endian int64
+//  If the appender was made by MakeSidecarAppender, all of the above
+//    is written to the sidecar file instead, and the file being
+//    appended to is left ending in the last appended block
+//  If $appender.Durable, the blocks are synced to disk before the
+//    index is written, and the index is synced after
+//  If writing the index fails, whatever was written of it is
+//    truncated off and the appender stays open, so Close can be
+//    called again to retry
+//  The internal file handle for the file being appended to has been closed
+//  The undo record MakeAppender left is removed once the index is written
+//  Once Close has been called, appending returns ErrAlreadyClosed
+func (appender *BinAppender) Close() error {
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	if appender.closed {
+		return ErrAlreadyClosed
+	}
+	appender.waitIdle()
+	err := appender.writeIndexFile()
+	if err != nil {
+		return err
+	}
+	appender.closed = true
+	err = appender.fileHandle.Close()
+	if appender.sidecarFilename != "" {
+		return err
+	}
+	undoErr := removeUndo(appender.fileHandle.Name())
+	if err == nil {
+		err = undoErr
+	}
+	return err
+}
+
+//Writes the index for Close, to the sidecar file if there is one.
+//On error, a half written index in the appended file is truncated
+//off, so that Close can be tried again.
+func (appender *BinAppender) writeIndexFile() error {
+	if appender.Durable {
+		err := appender.fileHandle.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	//Sidecar indexes start at the beginning of their own file
+	if appender.sidecarFilename != "" {
+		indexWriter, err := os.Create(appender.sidecarFilename)
+		if err != nil {
+			return err
+		}
+		err = appender.writeIndex(indexWriter, 0)
+		if err == nil && appender.Durable {
+			err = indexWriter.Sync()
+		}
+		closeErr := indexWriter.Close()
+		if err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	jsonPtr, err := appender.fileHandle.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	err = appender.writeIndex(appender.fileHandle, jsonPtr)
+	if err == nil && appender.Durable {
+		err = appender.fileHandle.Sync()
+	}
+	if err != nil {
+		return appender.truncateTo(jsonPtr, err)
+	}
+	return nil
+}
+
+//Writes the index and trailer to indexWriter, with jsonPtr as the
+//location of the index within its file
+func (appender *BinAppender) writeIndex(indexWriter io.Writer, jsonPtr int64) error {
+	var indexBytes []byte
+	var err error
+	indexFormat := indexFormatJSON
+	if appender.BinaryIndex {
+		indexFormat = indexFormatBinary
+		indexBytes, err = encodeBinaryIndex(appender.metadata)
+	} else if appender.IndentIndex {
+		indexBytes, err = json.MarshalIndent(appender.metadata, "", "\t")
+	} else {
+		indexBytes, err = json.Marshal(appender.metadata)
+	}
+	//Should not happen
+	if err != nil {
+		return err
+	}
+	compress := appender.CompressIndex && indexFormat == indexFormatJSON
+	return writeTrailer(indexWriter, indexBytes, indexFormat, compress, jsonPtr)
+}
+
+// Procedure:
+//  BinAppender.FinalizeAtomic
+// Purpose:
+//  To finish the file like Close, without ever leaving the file
+//    half finalized if the process dies partway through
+// Parameters:
+//   The BinAppender being acted upon: appender
+// Produces:
+//   Any filesystem errors: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  err is ErrAlreadyClosed, with nothing written, if Close or
+//    FinalizeAtomic has already finished the appender
+//  The result is the same as for Close, except that the file with the
+//    trailer is written to a temporary file in the same directory and
+//    renamed over the original, so the original is either untouched
+//    or fully finalized
+//  Without a sidecar, this copies the whole file, so it costs disk
+//    space and time proportional to the file's size
+//  Waits for blocks being copied into the file first, so it can be
+//    called from a signal.Notify handler to keep the finished blocks of a long running
+//    pack readable when it is interrupted
+//  The appended file is closed before the temporary file is renamed
+//    over it, as Windows can't rename over open files
+//  As with Close, the undo record MakeAppender left is removed once
+//    the renamed file is in place
+//  On error, the temporary file is removed and the appender is left
+//    open, unless the appended file can't be reopened after a failed
+//    rename, in which case err says so and the appender is closed
+func (appender *BinAppender) FinalizeAtomic() error {
+	appender.mux.Lock()
+	defer appender.mux.Unlock()
+	if appender.closed {
+		return ErrAlreadyClosed
+	}
+	appender.waitIdle()
+
+	targetName := appender.fileHandle.Name()
+	if appender.sidecarFilename != "" {
+		targetName = appender.sidecarFilename
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(targetName), filepath.Base(targetName) + ".finalize")
+	if err != nil {
+		return err
+	}
+	err = appender.writeFinalized(tempFile)
+	if err == nil {
+		err = tempFile.Close()
+	} else {
+		_ = tempFile.Close()
+	}
+	if err == nil {
+		err = appender.renameFinalized(tempFile.Name(), targetName)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	appender.closed = true
+	if appender.sidecarFilename == "" {
+		//Already closed by renameFinalized
+		return removeUndo(targetName)
+	}
+	return appender.fileHandle.Close()
+}
+
+//Renames FinalizeAtomic's temporary file over targetName. Without a
+//sidecar, that is the appended file itself, which is closed first since
+//Windows can't rename over open files, and reopened if the rename fails
+//so the appender can still be used.
+func (appender *BinAppender) renameFinalized(tempName string, targetName string) error {
+	if appender.sidecarFilename != "" {
+		return os.Rename(tempName, targetName)
+	}
+	//The handle is released even if Close fails, so reopen on any error
+	err := appender.fileHandle.Close()
+	if err == nil {
+		err = os.Rename(tempName, targetName)
+		if err == nil {
+			return nil
+		}
+	}
+	fileHandle, reopenErr := openForAppend(targetName)
+	if reopenErr == nil {
+		_, reopenErr = fileHandle.Seek(0, io.SeekEnd)
+		if reopenErr != nil {
+			_ = fileHandle.Close()
+		}
+	}
+	if reopenErr != nil {
+		//There's nothing left to append to
+		appender.closed = true
+		return errors.New(fmt.Sprintf("%s; reopening %s to carry on: %s", err, targetName, reopenErr))
+	}
+	appender.fileHandle = fileHandle
+	return err
+}
+
+//Writes what Close would leave at the end of FinalizeAtomic's target into
+//tempFile, copying over the appended file's contents unless there is a sidecar
+func (appender *BinAppender) writeFinalized(tempFile *os.File) error {
+	var jsonPtr int64
+	if appender.sidecarFilename == "" {
+		info, err := appender.fileHandle.Stat()
+		if err != nil {
+			return err
+		}
+		err = tempFile.Chmod(info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		jsonPtr, err = appender.fileHandle.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tempFile, io.NewSectionReader(appender.fileHandle, 0, jsonPtr))
+		if err != nil {
+			return err
+		}
+	} else {
+		//The blocks stay where they are, so make sure they are on disk
+		//before the index that points to them is
+		err := appender.fileHandle.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	err := appender.writeIndex(tempFile, jsonPtr)
+	if err != nil {
+		return err
+	}
+	return tempFile.Sync()
 }
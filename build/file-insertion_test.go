@@ -0,0 +1,803 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"os"
+	"io"
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"fmt"
+	"sync"
+	"path/filepath"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+//Endless random data, so it can't compress, that counts how much was read
+type endlessReader struct {
+	random *rand.Rand
+	read   int64
+}
+
+func (reader *endlessReader) Read(p []byte) (int, error) {
+	n, _ := reader.random.Read(p)
+	reader.read += int64(n)
+	return n, nil
+}
+
+func TestSizeLimitsStopEndlessStreams(t *testing.T) {
+	const limit = 1 << 20
+	tests := []struct {
+		name         string
+		maxBlockSize int64
+		maxTotalSize int64
+		//What the error should mention
+		want string
+	}{
+		{"MaxBlockSize", limit, 0, "MaxBlockSize"},
+		{"MaxTotalSize", 0, limit, "MaxTotalSize"},
+		{"both", limit, 2 * limit, "MaxBlockSize"},
+	}
+	//Every way of appending a block from an endless stream
+	methods := []struct {
+		name   string
+		append func(appender *BinAppender, source io.Reader) error
+	}{
+		{"AppendStreamReader", func(appender *BinAppender, source io.Reader) error {
+			return appender.AppendStreamReader("endless", source)
+		}},
+		{"AppendWriter", func(appender *BinAppender, source io.Reader) error {
+			writer, err := appender.AppendWriter("endless")
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(writer, source)
+			closeErr := writer.Close()
+			if err == nil {
+				err = closeErr
+			}
+			return err
+		}},
+		{"ReserveBlock", func(appender *BinAppender, source io.Reader) error {
+			return appender.ReserveBlock("endless", func(w io.Writer) error {
+				_, err := io.Copy(w, source)
+				return err
+			})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := testBinary(t)
+			appender, err := MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appender.MaxBlockSize = test.maxBlockSize
+			appender.MaxTotalSize = test.maxTotalSize
+			for _, method := range methods {
+				source := &endlessReader{random: rand.New(rand.NewSource(1))}
+				err = method.append(appender, source)
+				if err == nil || !strings.Contains(err.Error(), test.want) {
+					t.Fatalf("%s: expected an error about %s, got %v", method.name, test.want, err)
+				}
+				//Allow for the compressor's and write buffer's slack
+				if source.read > 2 * limit {
+					t.Errorf("%s read %d bytes before stopping, expected not much more than %d",
+						method.name, source.read, limit)
+				}
+			}
+			if info, err := os.Stat(binary); err != nil || info.Size() > limit {
+				t.Errorf("stopped appends grew the file past the limit: %v", err)
+			}
+
+			//Small blocks still fit afterwards
+			if err = appender.AppendStreamReader("small", strings.NewReader("small")); err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestBlock(t, binary, "small"); got != "small" {
+				t.Errorf("small is %q", got)
+			}
+		})
+	}
+}
+
+func TestSizeLimitsAllowStoringBlocksThatFit(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(2)).Read(random)
+	//gzip makes random data a little bigger, but it fits stored
+	appender.MaxBlockSize = int64(len(random))
+	err = appender.AppendStreamReader("random", strings.NewReader(string(random)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestBlock(t, binary, "random"); got != string(random) {
+		t.Error("random did not read back as packed")
+	}
+}
+
+func TestCloseCanBeRetriedAfterFailing(t *testing.T) {
+	binary := testBinary(t)
+	sidecarDir := filepath.Join(filepath.Dir(binary), "not yet made")
+	sidecar := filepath.Join(sidecarDir, "index")
+	appender, err := MakeSidecarAppender(binary, sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.AppendStreamReader("block", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err == nil {
+		t.Fatal("writing the sidecar into a missing directory should fail")
+	}
+
+	if err = os.Mkdir(sidecarDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatalf("retrying Close: %s", err)
+	}
+	if err = appender.Close(); err != ErrAlreadyClosed {
+		t.Errorf("closing again gave %v, expected ErrAlreadyClosed", err)
+	}
+	extractor, err := MakeSidecarExtractor(binary, sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := extractor.ByteArray("block")
+	if err != nil || string(data) != "data" {
+		t.Errorf("block is %q, %v", data, err)
+	}
+}
+
+func TestAppendWithoutContentionSkipsTempFiles(t *testing.T) {
+	binary := testBinary(t)
+	//Any temporary file would fail to be made
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.AppendStreamReader("block", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestBlock(t, binary, "block"); got != "data" {
+		t.Errorf("block is %q", got)
+	}
+}
+
+//Meant to be run with -race
+func TestConcurrentAppends(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 32
+	contents := make(map[string]string, count)
+	for ii := 0; ii < count; ii++ {
+		name := fmt.Sprintf("block-%d", ii)
+		contents[name] = strings.Repeat(name, 1000 * (ii + 1))
+	}
+	var wait sync.WaitGroup
+	errs := make(chan error, count)
+	for name, content := range contents {
+		wait.Add(1)
+		go func(name string, content string) {
+			defer wait.Done()
+			errs <- appender.AppendStreamReader(name, strings.NewReader(content))
+		}(name, content)
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	extractor, err := MakeStrictAppendExtractor(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range contents {
+		data, err := extractor.ByteArray(name)
+		if err != nil || string(data) != content {
+			t.Errorf("%s did not read back as packed: %v", name, err)
+		}
+	}
+}
+
+func TestPackingTwiceKeepsBothRounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(appender *BinAppender)
+	}{
+		{"json index", func(appender *BinAppender) {}},
+		{"binary index", func(appender *BinAppender) { appender.BinaryIndex = true }},
+		{"gzipped index", func(appender *BinAppender) { appender.CompressIndex = true }},
+	}
+	rounds := []map[string]string{
+		{"first/a": "alpha", "first/b": "bravo"},
+		{"second/c": "charlie"},
+		{"third/d": "delta"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := testBinary(t)
+			for _, round := range rounds {
+				appender, err := MakeAppender(binary)
+				if err != nil {
+					t.Fatal(err)
+				}
+				test.configure(appender)
+				for name, content := range round {
+					if err = appender.AppendStreamReader(name, strings.NewReader(content)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err = appender.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			//The old trailers were cut off rather than buried between blocks
+			extractor, err := MakeStrictAppendExtractor(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, round := range rounds {
+				for name, content := range round {
+					data, err := extractor.ByteArray(name)
+					if err != nil || string(data) != content {
+						t.Errorf("%s is %q, %v; expected %q", name, data, err, content)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPackingOverCorruptIndexFails(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.AppendStreamReader("block", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	extractor, err := MakeAppendExtractor(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Flip a byte in the middle of the index, which its checksum catches
+	data[extractor.indexPtr + 2] ^= 0xff
+	if err = ioutil.WriteFile(binary, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = MakeAppender(binary); err == nil {
+		t.Fatal("packing after a corrupt index should fail rather than bury its blocks")
+	}
+}
+
+//Reads from source until it has handed out limit bytes, then fails
+type failingReader struct {
+	source io.Reader
+	limit  int64
+}
+
+var errTestReadFailed = errors.New("test read failed")
+
+func (reader *failingReader) Read(p []byte) (int, error) {
+	if reader.limit <= 0 {
+		return 0, errTestReadFailed
+	}
+	if int64(len(p)) > reader.limit {
+		p = p[:reader.limit]
+	}
+	n, err := reader.source.Read(p)
+	reader.limit -= int64(n)
+	return n, err
+}
+
+func TestFailedAppendsLeaveFileUnchanged(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(appender *BinAppender)
+	}{
+		{"gzip", func(appender *BinAppender) {}},
+		{"unbuffered", func(appender *BinAppender) { appender.WriteBufferSize = -1 }},
+		{"parallel", func(appender *BinAppender) { appender.ParallelCompress = true }},
+		{"fast pack", func(appender *BinAppender) { appender.FastPack = true }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := testBinary(t)
+			appender, err := MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.configure(appender)
+			if err = appender.AppendStreamReader("before", strings.NewReader("kept")); err != nil {
+				t.Fatal(err)
+			}
+			before, err := os.Stat(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//Enough random data that some of it reaches the file before failing
+			source := &failingReader{source: rand.New(rand.NewSource(1)), limit: 4 << 20}
+			err = appender.AppendStreamReader("broken", source)
+			if !errors.Is(err, errTestReadFailed) {
+				t.Fatalf("expected the read error, got %v", err)
+			}
+			after, err := os.Stat(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Size() != before.Size() {
+				t.Errorf("file went from %d to %d bytes after a failed append", before.Size(), after.Size())
+			}
+
+			if err = appender.AppendStreamReader("after", strings.NewReader("also kept")); err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if content := readTestBlock(t, binary, "before"); content != "kept" {
+				t.Errorf("before is %q", content)
+			}
+			if content := readTestBlock(t, binary, "after"); content != "also kept" {
+				t.Errorf("after is %q", content)
+			}
+			extractor, err := MakeStrictAppendExtractor(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = extractor.ByteArray("broken"); err == nil {
+				t.Error("the failed block should not be in the index")
+			}
+		})
+	}
+}
+
+var writeBufferSizes = []struct {
+	name string
+	size int
+}{
+	{"unbuffered", -1},
+	{"4KiB", 4 << 10},
+	{"default", 0},
+	{"1MiB", 1 << 20},
+}
+
+func TestWriteBufferSizesRoundTrip(t *testing.T) {
+	data := string(compressibleData(3 << 20))
+	for _, bufferSize := range writeBufferSizes {
+		t.Run(bufferSize.name, func(t *testing.T) {
+			binary := testBinary(t)
+			appender, err := MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appender.WriteBufferSize = bufferSize.size
+			if err = appender.AppendStreamReader("large", strings.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			//Tiny blocks leave most of the buffer unused, so have to be flushed
+			if err = appender.AppendStreamReader("small", strings.NewReader("tiny")); err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if content := readTestBlock(t, binary, "large"); content != data {
+				t.Errorf("got back %d bytes that don't match the %d packed", len(content), len(data))
+			}
+			if content := readTestBlock(t, binary, "small"); content != "tiny" {
+				t.Errorf("small is %q", content)
+			}
+		})
+	}
+}
+
+func BenchmarkAppendWriteBufferSizes(b *testing.B) {
+	data := compressibleData(16 << 20)
+	for _, bufferSize := range writeBufferSizes {
+		b.Run(bufferSize.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for ii := 0; ii < b.N; ii++ {
+				b.StopTimer()
+				appender, err := MakeAppender(testBinary(b))
+				if err != nil {
+					b.Fatal(err)
+				}
+				appender.WriteBufferSize = bufferSize.size
+				b.StartTimer()
+				err = appender.AppendStreamReader("large", io.MultiReader(bytes.NewReader(data)))
+				if err == nil {
+					err = appender.Close()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+//A small config file, like the ones dictionaries are meant for
+func testConfig(id int) string {
+	return fmt.Sprintf(`{"id": %d, "container": "webm", "video_codec": "libvpx-vp9", "pix_format": "yuv420p", "two_pass": true, "audio_codec": "libopus", "subtitle_codec": "webvtt", "handle_unuseable_streams": false}`, id)
+}
+
+func TestDictionariesShrinkSmallSimilarBlocks(t *testing.T) {
+	const blocks = 100
+	//Packs the configs, returning the size of the packed blocks
+	pack := func(t *testing.T, framing Framing, dictionary []byte) int64 {
+		binary := testBinary(t)
+		before, err := os.Stat(binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appender, err := MakeAppender(binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appender.Framing = framing
+		if err = appender.UseDictionary(dictionary); err != nil {
+			t.Fatal(err)
+		}
+		for ii := 0; ii < blocks; ii++ {
+			name := fmt.Sprintf("config-%d.json", ii)
+			if err = appender.AppendStreamReader(name, strings.NewReader(testConfig(ii))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//Measure before the index, which is the same size either way
+		after, err := appender.fileHandle.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = appender.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for ii := 0; ii < blocks; ii++ {
+			name := fmt.Sprintf("config-%d.json", ii)
+			if content := readTestBlock(t, binary, name); content != testConfig(ii) {
+				t.Fatalf("%s is %q", name, content)
+			}
+		}
+		return after.Size() - before.Size()
+	}
+
+	for _, framing := range []Framing{FramingZlib, FramingDeflate} {
+		t.Run(framing.ToString(), func(t *testing.T) {
+			without := pack(t, framing, nil)
+			with := pack(t, framing, []byte(testConfig(0)))
+			t.Logf("%d blocks took %d bytes with a dictionary and %d without", blocks, with, without)
+			//Includes the one stored copy of the dictionary
+			if with*2 > without {
+				t.Errorf("%d blocks took %d bytes with a dictionary and %d without; expected at most half", blocks, with, without)
+			}
+		})
+	}
+}
+
+func TestPackingIntoReadOnlyFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(binary string) (*BinAppender, error)
+		//What the error should mention, "" if it should work
+		want string
+	}{
+		{"in place", MakeAppender, "permission denied; is the binary or its directory read-only?"},
+		{"as a copy", func(binary string) (*BinAppender, error) {
+			return MakeAppenderCopy(binary, binary + ".packed")
+		}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := testBinary(t)
+			if err := os.Chmod(binary, 0444); err != nil {
+				t.Fatal(err)
+			}
+			appender, err := test.open(binary)
+			if test.want != "" {
+				if err == nil && os.Geteuid() == 0 {
+					_ = appender.Close()
+					t.Skip("root can write to read-only files")
+				}
+				if err == nil || !strings.Contains(err.Error(), test.want) || !strings.Contains(err.Error(), binary) {
+					t.Fatalf("expected an error about %s being read-only, got %v", binary, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.AppendStreamReader("block", strings.NewReader("data")); err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if content, err := ioutil.ReadFile(binary); err != nil || string(content) != "not really a binary" {
+				t.Errorf("the read-only original became %q, %v", content, err)
+			}
+			if info, err := os.Stat(binary + ".packed"); err != nil || info.Mode().Perm() != 0444 {
+				t.Errorf("expected the copy to be read-only like the original, got %v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestAppendTarKeepsModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    int64
+		content string
+		want    os.FileMode
+	}{
+		//Scripts don't look executable, so only the header says they are
+		{"run.sh", 0755, "#!/bin/sh\necho hi\n", 0755},
+		{"secret.key", 0600, "key", 0600},
+		{"config.json", 0644, "{}", 0644},
+		//Type and setuid bits are dropped
+		{"setuid", 04755, "data", 0755},
+	}
+	var tarData bytes.Buffer
+	tarWriter := tar.NewWriter(&tarData)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		header := &tar.Header{Name: "dir/" + test.name, Typeflag: tar.TypeReg, Mode: test.mode, Size: int64(len(test.content))}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(test.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.AppendTar(&tarData); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	extractor, err := MakeStrictAppendExtractor(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputDir := t.TempDir()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(outputDir, test.name)
+			if err := extractor.ExtractToFile("dir/" + test.name, path); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != test.want {
+				t.Errorf("extracted with mode %v; expected %v", info.Mode().Perm(), test.want)
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil || string(content) != test.content {
+				t.Errorf("extracted %q, %v; expected %q", content, err, test.content)
+			}
+		})
+	}
+}
+
+//Meant to be run with -race
+func TestAppendNamedFileRecordsModeWithBlock(t *testing.T) {
+	sources := t.TempDir()
+	first := filepath.Join(sources, "first")
+	second := filepath.Join(sources, "second")
+	if err := ioutil.WriteFile(first, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(second, []byte("second"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	//The mode packed under name, or 0 if the block isn't there
+	packedMode := func(t *testing.T, binary string, name string) os.FileMode {
+		t.Helper()
+		extractor, err := MakeStrictAppendExtractor(binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := extractor.Metadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, block := range metadata.Blocks {
+			if block.Name == name {
+				return block.Mode
+			}
+		}
+		return 0
+	}
+
+	t.Run("racing close", func(t *testing.T) {
+		for ii := 0; ii < 20; ii++ {
+			binary := testBinary(t)
+			appender, err := MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appended := make(chan error)
+			go func() {
+				appended <- appender.AppendNamedFile("file", first)
+			}()
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+			//Whichever won, a packed block has its mode
+			appendErr := <-appended
+			if mode := packedMode(t, binary, "file"); mode != 0600 && (appendErr == nil || mode != 0) {
+				t.Fatalf("packed with mode %v after appending gave %v; expected 0600", mode, appendErr)
+			}
+		}
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		binary := testBinary(t)
+		appender, err := MakeAppender(binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appender.OnDuplicate = DuplicateReplace
+		if err = appender.AppendNamedFile("file", first); err != nil {
+			t.Fatal(err)
+		}
+		if err = appender.AppendNamedFile("file", second); err != nil {
+			t.Fatal(err)
+		}
+		if err = appender.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if mode := packedMode(t, binary, "file"); mode != 0750 {
+			t.Errorf("packed with mode %v; expected 0750", mode)
+		}
+		if got := readTestBlock(t, binary, "file"); got != "second" {
+			t.Errorf("block is %q", got)
+		}
+	})
+}
+
+//Whether this process has path open, as far as /proc can tell
+func hasOpen(t *testing.T, path string) bool {
+	t.Helper()
+	entries, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can't list open files here:", err)
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err == nil && target == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFinalizeAtomicClosesTheFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		sidecar bool
+	}{
+		{"in place", false},
+		{"with a sidecar", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := testBinary(t)
+			sidecar := binary + ".index"
+			var appender *BinAppender
+			var err error
+			if test.sidecar {
+				appender, err = MakeSidecarAppender(binary, sidecar)
+			} else {
+				appender, err = MakeAppender(binary)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.AppendStreamReader("block", strings.NewReader("data")); err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.FinalizeAtomic(); err != nil {
+				t.Fatal(err)
+			}
+			if hasOpen(t, binary) {
+				t.Errorf("%s is still open after FinalizeAtomic", binary)
+			}
+			if err = appender.FinalizeAtomic(); err != ErrAlreadyClosed {
+				t.Errorf("finalizing twice gave %v; expected ErrAlreadyClosed", err)
+			}
+
+			//Nothing but the results is left behind
+			files := listFiles(t, filepath.Dir(binary))
+			expected := []string{filepath.Base(binary)}
+			if test.sidecar {
+				expected = append(expected, filepath.Base(sidecar))
+			}
+			if strings.Join(files, " ") != strings.Join(expected, " ") {
+				t.Errorf("left %v; expected %v", files, expected)
+			}
+			var extractor *BinAppendExtractor
+			if test.sidecar {
+				extractor, err = MakeSidecarExtractor(binary, sidecar)
+			} else {
+				extractor, err = MakeStrictAppendExtractor(binary)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := extractor.ByteArray("block"); err != nil || string(data) != "data" {
+				t.Errorf("block is %q, %v", data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"hash"
+	"hash/crc32"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"lukechampine.com/blake3"
+)
+
+//Hash of a block's uncompressed data
+type HashAlgo string
+
+const (
+	//IEEE crc32. Fast, and enough to catch corruption, but trivial to
+	//forge. The default for per-block checksums.
+	HashCRC32 HashAlgo = "crc32"
+	//SHA-256, for when collisions matter. The default for manifests.
+	HashSHA256 HashAlgo = "sha256"
+	//256 bit BLAKE3. As strong as SHA-256, and much faster on large
+	//blocks like media files.
+	HashBLAKE3 HashAlgo = "blake3"
+	//Record no checksum
+	HashNone HashAlgo = "none"
+)
+
+//Returned when a block has no checksum to check against
+var ErrNoChecksum = errors.New("block has no checksum")
+
+//A new hash for algo, nil for HashNone
+func (algo HashAlgo) newHash() (hash.Hash, error) {
+	switch algo {
+	case HashCRC32:
+		return crc32.NewIEEE(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE3:
+		return blake3.New(32, nil), nil
+	case HashNone:
+		return nil, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown hash algorithm %q, expected %s, %s, %s, or %s", algo, HashCRC32, HashSHA256, HashBLAKE3, HashNone))
+	}
+}
+
+//The hex encoded sum of hasher, "" if hasher is nil
+func hexSum(hasher hash.Hash) string {
+	if hasher == nil {
+		return ""
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
@@ -0,0 +1,581 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package build
+
+import (
+	"io"
+	"bytes"
+	"sort"
+	"errors"
+	"fmt"
+	"encoding/json"
+	"encoding/binary"
+	"hash/crc32"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// The end of an appended file looks like:
+//  [index][checksum][trailerMagic][flags byte][index pointer]
+// where the index pointer is the little endian int64 location of
+// the start of the index. The low bits of the flags byte give the
+// index format. The checksum is only there if the flags say so.
+// The flags also say whether the index is gzipped.
+// Files from before the flags byte was added end in just
+// [json index][index pointer].
+// All numbers, in the trailer and the binary index, are little endian.
+// Only readTrailer and writeTrailer deal with the trailer's layout.
+const (
+	trailerMagic string = "TBAX"
+	//Length of the magic number and flags byte
+	trailerFlagsSize int64 = 5
+	indexPtrSize     int64 = 8
+	//Length of the crc32 of the index
+	indexChecksumSize int64 = 4
+
+	indexFormatMask byte = 0x0f
+	//The index is the json encoded appendedMetadata
+	indexFormatJSON byte = 0
+	//The index is a sorted table that can be searched without decoding all of it
+	indexFormatBinary byte = 1
+
+	//The index is followed by its IEEE crc32, little endian
+	trailerFlagChecksum byte = 0x10
+	//The numbers in the file are big endian. Never written; files with
+	//it set are rejected instead of having their pointers misread.
+	trailerFlagBigEndian byte = 0x20
+	//The index is gzipped, and the checksum is of the gzipped bytes.
+	//Only used with json indexes; binary ones are searched in place.
+	trailerFlagGzip byte = 0x40
+	//Every flag this version understands, anything else is rejected
+	trailerFlagsKnown byte = indexFormatMask | trailerFlagChecksum | trailerFlagBigEndian | trailerFlagGzip
+
+	//Largest value an int can hold, which is only 32 bits on some clients.
+	//Offsets are all int64, but anything turned into an int must fit here.
+	maxInt int64 = int64(^uint(0) >> 1)
+)
+
+//Returned by readIndex when the index does not match its checksum
+var ErrIndexCorrupted = errors.New("metadata corrupted: index does not match its checksum")
+
+// Type:
+//  blockIndex
+// Purpose:
+//  To look up where appended blocks live in a file,
+//  independent of how the index is stored
+type blockIndex interface {
+	//The MetadataVersion the index was written with
+	version() string
+	//Find the block named name, reading from file as needed
+	lookup(file io.ReaderAt, name string) (data appendedData, found bool, err error)
+	//All of the block names in the index
+	names(file io.ReaderAt) ([]string, error)
+}
+
+//Index backed by the fully decoded json metadata
+type jsonIndex struct {
+	metadata appendedMetadata
+}
+
+func (index *jsonIndex) version() string {
+	return index.metadata.Version
+}
+
+func (index *jsonIndex) lookup(_ io.ReaderAt, name string) (appendedData, bool, error) {
+	data, found := index.metadata.Data[name]
+	return data, found, nil
+}
+
+func (index *jsonIndex) names(_ io.ReaderAt) ([]string, error) {
+	names := make([]string, 0, len(index.metadata.Data))
+	for name := range index.metadata.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Type:
+//  binaryIndex
+// Purpose:
+//  To look up blocks in a binary index table without reading
+//  the whole table into memory
+// Notes:
+//  The table is laid out as (all integers little endian):
+//   version length uint16, version
+//   entry count uint64
+//   entry offsets [entry count]uint64, relative to the start of the table
+//   entries, sorted by name:
+//    name length uint32, name
+//    data length uint32, json encoded appendedData
+type binaryIndex struct {
+	//Location of the table in the file
+	start int64
+	size  int64
+
+	formatVersion string
+	count         int64
+	//Location of the offsets array relative to start
+	offsetsStart int64
+}
+
+func (index *binaryIndex) version() string {
+	return index.formatVersion
+}
+
+// Procedure:
+//  *binaryIndex.lookup
+// Purpose:
+//  To binary search the index table for a block name
+// Parameters:
+//  The index being searched: index *binaryIndex
+//  The file the table lives in: file io.ReaderAt
+//  The name to find: name string
+// Produces:
+//  The metadata for the block: data appendedData
+//  Whether the name was found: found bool
+//  Any errors reading the table: err error
+// Preconditions:
+//  index was produced by readIndex on file
+// Postconditions:
+//  Only O(log(count)) entries are read from file
+func (index *binaryIndex) lookup(file io.ReaderAt, name string) (data appendedData, found bool, err error) {
+	var searchErr error
+	position := sort.Search(int(index.count), func(ii int) bool {
+		if searchErr != nil {
+			return true
+		}
+		entryName, _, err := index.readEntry(file, int64(ii), false)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return entryName >= name
+	})
+	if searchErr != nil {
+		return data, false, searchErr
+	}
+	if int64(position) >= index.count {
+		return data, false, nil
+	}
+	entryName, data, err := index.readEntry(file, int64(position), true)
+	if err != nil {
+		return data, false, err
+	}
+	if entryName != name {
+		return appendedData{}, false, nil
+	}
+	return data, true, nil
+}
+
+func (index *binaryIndex) names(file io.ReaderAt) ([]string, error) {
+	names := make([]string, 0, index.count)
+	for ii := int64(0); ii < index.count; ii++ {
+		name, _, err := index.readEntry(file, ii, false)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Procedure:
+//  *binaryIndex.readEntry
+// Purpose:
+//  To read the entry at a position in the index table
+// Parameters:
+//  The index being read: index *binaryIndex
+//  The file the table lives in: file io.ReaderAt
+//  The position of the entry in the sorted table: position int64
+//  Whether to decode the block metadata as well as the name: withData bool
+// Produces:
+//  The name of the block: name string
+//  The block metadata, if withData: data appendedData
+//  Any errors: err error
+// Preconditions:
+//  0 <= position < index.count
+// Postconditions:
+//  err is non-nil if the entry runs outside of the table
+func (index *binaryIndex) readEntry(file io.ReaderAt, position int64, withData bool) (name string, data appendedData, err error) {
+	table := io.NewSectionReader(file, index.start, index.size)
+	uint64Bytes := make([]byte, 8)
+	err = readFullAt(table, uint64Bytes, index.offsetsStart+position*8)
+	if err != nil {
+		return "", data, err
+	}
+	entryPtr := int64(binary.LittleEndian.Uint64(uint64Bytes))
+
+	nameBytes, entryPtr, err := readLengthPrefixed(table, entryPtr)
+	if err != nil {
+		return "", data, err
+	}
+	if !withData {
+		return string(nameBytes), data, nil
+	}
+	dataBytes, _, err := readLengthPrefixed(table, entryPtr)
+	if err != nil {
+		return "", data, err
+	}
+	err = json.Unmarshal(dataBytes, &data)
+	return string(nameBytes), data, err
+}
+
+//Fills output from file starting at offset, going back for more if
+//file hands back fewer bytes than asked for without an error, as some
+//io.ReaderAts do
+func readFullAt(file io.ReaderAt, output []byte, offset int64) error {
+	_, err := io.ReadFull(io.NewSectionReader(file, offset, int64(len(output))), output)
+	return err
+}
+
+//Reads a uint32 length prefixed byte string at location in table,
+//returning it and the location right after it
+func readLengthPrefixed(table *io.SectionReader, location int64) ([]byte, int64, error) {
+	if location < 0 || location > table.Size()-4 {
+		return nil, 0, errors.New("index entry starts outside of the index")
+	}
+	lengthBytes := make([]byte, 4)
+	err := readFullAt(table, lengthBytes, location)
+	if err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.LittleEndian.Uint32(lengthBytes))
+	if location < 0 || length > table.Size()-location-4 || length > maxInt {
+		return nil, 0, errors.New("index entry runs past the end of the index")
+	}
+	output := make([]byte, length)
+	err = readFullAt(table, output, location+4)
+	if err != nil {
+		return nil, 0, err
+	}
+	return output, location + 4 + length, nil
+}
+
+// Procedure:
+//  encodeBinaryIndex
+// Purpose:
+//  To encode metadata as a binary index table
+// Parameters:
+//  The metadata to encode: metadata appendedMetadata
+// Produces:
+//  The encoded table: output []byte
+//  Any errors: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  output is laid out as described on binaryIndex
+func encodeBinaryIndex(metadata appendedMetadata) ([]byte, error) {
+	names := make([]string, 0, len(metadata.Data))
+	for name := range metadata.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries bytes.Buffer
+	entryPtrs := make([]uint64, len(names))
+	headerSize := 2 + int64(len(metadata.Version)) + 8 + 8*int64(len(names))
+	for ii, name := range names {
+		entryPtrs[ii] = uint64(headerSize + int64(entries.Len()))
+		dataBytes, err := json.Marshal(metadata.Data[name])
+		if err != nil {
+			return nil, err
+		}
+		writeLengthPrefixed(&entries, []byte(name))
+		writeLengthPrefixed(&entries, dataBytes)
+	}
+
+	var output bytes.Buffer
+	_ = binary.Write(&output, binary.LittleEndian, uint16(len(metadata.Version)))
+	output.WriteString(metadata.Version)
+	_ = binary.Write(&output, binary.LittleEndian, uint64(len(names)))
+	_ = binary.Write(&output, binary.LittleEndian, entryPtrs)
+	output.Write(entries.Bytes())
+	return output.Bytes(), nil
+}
+
+func writeLengthPrefixed(buffer *bytes.Buffer, data []byte) {
+	_ = binary.Write(buffer, binary.LittleEndian, uint32(len(data)))
+	buffer.Write(data)
+}
+
+// Type:
+//  trailer
+// Purpose:
+//  To hold what the end of an appended file says about its index
+type trailer struct {
+	//Location of the start of the index
+	indexPtr int64
+	//Location just past the end of the index
+	indexEnd int64
+	//Index format and trailerFlag bits, 0 for old files without flags
+	flags byte
+	//IEEE crc32 of the index, 0 if there isn't one
+	checksum uint32
+}
+
+// Procedure:
+//  readTrailer
+// Purpose:
+//  To decode the trailer at the end of an appended file
+// Parameters:
+//  The file to read from: file io.ReaderAt
+//  The size of the file: fileSize int64
+// Produces:
+//  The decoded trailer: output trailer
+//  Any errors in reading, or if the trailer is not usable: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  0 <= output.indexPtr <= output.indexEnd <= fileSize
+//  err is non-nil if the flags byte has bits this version doesn't
+//    know about, or says the file is big endian
+func readTrailer(file io.ReaderAt, fileSize int64) (output trailer, err error) {
+	if fileSize < indexPtrSize {
+		return output, errors.New("file too small to have an index pointer")
+	}
+
+	//Check the flags before trusting the byte order of anything else
+	output.indexEnd = fileSize - indexPtrSize
+	if fileSize >= indexPtrSize+trailerFlagsSize {
+		flagBytes := make([]byte, trailerFlagsSize)
+		err = readFullAt(file, flagBytes, fileSize-indexPtrSize-trailerFlagsSize)
+		if err != nil {
+			return output, err
+		}
+		if string(flagBytes[:len(trailerMagic)]) == trailerMagic {
+			output.flags = flagBytes[len(trailerMagic)]
+			output.indexEnd -= trailerFlagsSize
+		}
+	}
+	if output.flags&^trailerFlagsKnown != 0 {
+		return output, errors.New(fmt.Sprintf("unknown trailer flags %#x", output.flags&^trailerFlagsKnown))
+	}
+	if output.flags&trailerFlagBigEndian != 0 {
+		return output, errors.New("big endian trailers are not supported")
+	}
+
+	indexPtrBytes := make([]byte, indexPtrSize)
+	err = readFullAt(file, indexPtrBytes, fileSize-indexPtrSize)
+	if err != nil {
+		return output, err
+	}
+	output.indexPtr = int64(binary.LittleEndian.Uint64(indexPtrBytes))
+
+	if output.flags&trailerFlagChecksum != 0 {
+		output.indexEnd -= indexChecksumSize
+		if output.indexEnd < 0 {
+			return output, errors.New("file too small to have an index checksum")
+		}
+		checksumBytes := make([]byte, indexChecksumSize)
+		err = readFullAt(file, checksumBytes, output.indexEnd)
+		if err != nil {
+			return output, err
+		}
+		output.checksum = binary.LittleEndian.Uint32(checksumBytes)
+	}
+	if output.indexPtr < 0 || output.indexPtr > output.indexEnd {
+		return output, errors.New(fmt.Sprintf("index pointer %d outside of file", output.indexPtr))
+	}
+	return output, nil
+}
+
+// Procedure:
+//  writeTrailer
+// Purpose:
+//  To write an encoded index followed by its trailer
+// Parameters:
+//  Where to write: writer io.Writer
+//  The encoded index: index []byte
+//  The format of the index: indexFormat byte
+//  Whether to gzip the index: compress bool
+//  Where the index starts in its file: indexPtr int64
+// Produces:
+//  Any errors in writing: err error
+// Preconditions:
+//  indexFormat is one of the indexFormat constants
+//  If compress, indexFormat is indexFormatJSON
+// Postconditions:
+//  readTrailer on the result gives back indexPtr and indexFormat,
+//    with trailerFlagChecksum set, and trailerFlagGzip if compress
+func writeTrailer(writer io.Writer, index []byte, indexFormat byte, compress bool, indexPtr int64) error {
+	flags := indexFormat | trailerFlagChecksum
+	if compress {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		_, _ = gzipWriter.Write(index)
+		//Writes to a bytes.Buffer can't fail
+		_ = gzipWriter.Close()
+		index = compressed.Bytes()
+		flags |= trailerFlagGzip
+	}
+	var output bytes.Buffer
+	output.Write(index)
+	_ = binary.Write(&output, binary.LittleEndian, crc32.ChecksumIEEE(index))
+	output.WriteString(trailerMagic)
+	output.WriteByte(flags)
+	_ = binary.Write(&output, binary.LittleEndian, uint64(indexPtr))
+	_, err := writer.Write(output.Bytes())
+	return err
+}
+
+// Procedure:
+//  readIndex
+// Purpose:
+//  To find and open the index of appended blocks at the end of a file
+// Parameters:
+//  The file to read: file io.ReaderAt
+//  The size of the file: fileSize int64
+// Produces:
+//  The index of the file: index blockIndex
+//  The location of the start of the index: indexPtr int64
+//  Any errors: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  err is non-nil if file does not end in an index written by a BinAppender
+//  err is ErrIndexCorrupted if the index has a checksum that it doesn't match
+//  Json indexes are fully decoded; binary indexes only have their header read
+func readIndex(file io.ReaderAt, fileSize int64) (index blockIndex, indexPtr int64, err error) {
+	indexTrailer, err := readTrailer(file, fileSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	indexPtr = indexTrailer.indexPtr
+	indexReader := io.NewSectionReader(file, indexPtr, indexTrailer.indexEnd-indexPtr)
+
+	//A zero checksum is treated as not having one
+	if indexTrailer.checksum != 0 {
+		hash := crc32.NewIEEE()
+		_, err = io.Copy(hash, indexReader)
+		if err != nil {
+			return nil, 0, err
+		}
+		if hash.Sum32() != indexTrailer.checksum {
+			return nil, indexPtr, ErrIndexCorrupted
+		}
+		_, err = indexReader.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	flags := indexTrailer.flags
+	if flags&trailerFlagGzip != 0 && flags&indexFormatMask != indexFormatJSON {
+		return nil, 0, errors.New("only json indexes can be gzipped")
+	}
+	switch flags & indexFormatMask {
+	case indexFormatJSON:
+		var jsonReader io.Reader = indexReader
+		jsonSize := indexReader.Size()
+		if flags&trailerFlagGzip != 0 {
+			gzipReader, err := gzip.NewReader(indexReader)
+			if err != nil {
+				return nil, 0, err
+			}
+			jsonBytes, err := ioutil.ReadAll(gzipReader)
+			if err != nil {
+				return nil, 0, err
+			}
+			jsonReader = bytes.NewReader(jsonBytes)
+			jsonSize = int64(len(jsonBytes))
+		}
+		jsonIndex := &jsonIndex{}
+		decoder := json.NewDecoder(jsonReader)
+		err = decoder.Decode(&jsonIndex.metadata)
+		if err != nil {
+			return nil, 0, err
+		}
+		if decoder.InputOffset() != jsonSize {
+			return nil, 0, errors.New("json index does not fill the space before the index pointer")
+		}
+		if jsonIndex.metadata.Data == nil {
+			return nil, 0, errors.New("json index has no data")
+		}
+		return jsonIndex, indexPtr, nil
+	case indexFormatBinary:
+		binaryIndex := &binaryIndex{start: indexPtr, size: indexReader.Size()}
+		versionBytes, err := readUint16Prefixed(indexReader)
+		if err != nil {
+			return nil, 0, err
+		}
+		binaryIndex.formatVersion = string(versionBytes)
+		countBytes := make([]byte, 8)
+		_, err = io.ReadFull(indexReader, countBytes)
+		if err != nil {
+			return nil, 0, err
+		}
+		binaryIndex.count = int64(binary.LittleEndian.Uint64(countBytes))
+		binaryIndex.offsetsStart = 2 + int64(len(versionBytes)) + 8
+		//Divide rather than multiply so a corrupt count can't overflow
+		if binaryIndex.count < 0 || binaryIndex.count > (binaryIndex.size-binaryIndex.offsetsStart)/8 {
+			return nil, 0, errors.New("binary index entry count does not fit in the index")
+		}
+		if binaryIndex.count > maxInt {
+			return nil, 0, errors.New("binary index has too many entries to search on this platform")
+		}
+		return binaryIndex, indexPtr, nil
+	default:
+		return nil, 0, errors.New(fmt.Sprintf("unknown index format %d", flags&indexFormatMask))
+	}
+}
+
+func readUint16Prefixed(reader io.Reader) ([]byte, error) {
+	lengthBytes := make([]byte, 2)
+	_, err := io.ReadFull(reader, lengthBytes)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]byte, binary.LittleEndian.Uint16(lengthBytes))
+	_, err = io.ReadFull(reader, output)
+	return output, err
+}
+
+// Procedure:
+//  readAllMetadata
+// Purpose:
+//  To read every entry out of an index
+// Parameters:
+//  The index: index blockIndex
+//  The file the index lives in: file io.ReaderAt
+// Produces:
+//  All of the metadata in the index: metadata appendedMetadata
+//  Any errors: err error
+// Preconditions:
+//  index was produced by readIndex on file
+// Postconditions:
+//  metadata is equivalent to what the BinAppender that wrote file held at Close
+func readAllMetadata(index blockIndex, file io.ReaderAt) (metadata appendedMetadata, err error) {
+	metadata.Version = index.version()
+	metadata.Data = make(map[string]appendedData)
+	names, err := index.names(file)
+	if err != nil {
+		return metadata, err
+	}
+	for _, name := range names {
+		data, _, err := index.lookup(file, name)
+		if err != nil {
+			return metadata, err
+		}
+		metadata.Data[name] = data
+	}
+	return metadata, nil
+}
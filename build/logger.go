@@ -0,0 +1,126 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package build
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/yourfin/transcodebot/common"
+)
+
+// Type:
+//  Logger
+// Purpose:
+//  To let programs embedding Build decide where its messages go
+// Postconditions:
+//  Build only calls its Logger from the goroutine Build was called
+//    from. Messages about a target compiled in the background are
+//    held until the target finishes, then passed on together.
+type Logger interface {
+	//Normal progress messages
+	Infof(format string, args ...interface{})
+	//Something went wrong with a target
+	//Build carries on with the other targets and returns an error afterwards
+	Errorf(format string, args ...interface{})
+	//Details only worth showing when asked for
+	Verbosef(format string, args ...interface{})
+}
+
+//Logger that prints with the common package's functions, as the CLI does
+type commonLogger struct{}
+
+func (commonLogger) Infof(format string, args ...interface{}) {
+	common.Println(fmt.Sprintf(format, args...))
+}
+
+func (commonLogger) Errorf(format string, args ...interface{}) {
+	common.Eprintln(fmt.Sprintf(format, args...))
+}
+
+func (commonLogger) Verbosef(format string, args ...interface{}) {
+	common.PrintVerbose(fmt.Sprintf(format, args...))
+}
+
+//The logger to use for settings, defaulting to the common package's functions
+func (settings BuildSettings) logger() Logger {
+	if settings.Logger == nil {
+		return commonLogger{}
+	}
+	return settings.Logger
+}
+
+//Levels of the Logger methods, for replaying a bufferedLogger
+type logLevel int
+
+const (
+	levelInfo logLevel = iota
+	levelError
+	levelVerbose
+)
+
+type logEntry struct {
+	level   logLevel
+	message string
+}
+
+//Logger that holds on to messages until they're replayed, so that
+//everything about one target comes out together when several are
+//being compiled at once
+type bufferedLogger struct {
+	mux     sync.Mutex
+	entries []logEntry
+}
+
+func (buffer *bufferedLogger) add(level logLevel, format string, args []interface{}) {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	buffer.entries = append(buffer.entries, logEntry{level: level, message: fmt.Sprintf(format, args...)})
+}
+
+func (buffer *bufferedLogger) Infof(format string, args ...interface{}) {
+	buffer.add(levelInfo, format, args)
+}
+
+func (buffer *bufferedLogger) Errorf(format string, args ...interface{}) {
+	buffer.add(levelError, format, args)
+}
+
+func (buffer *bufferedLogger) Verbosef(format string, args ...interface{}) {
+	buffer.add(levelVerbose, format, args)
+}
+
+//Passes every buffered message on to logger, in the order they were logged
+func (buffer *bufferedLogger) replay(logger Logger) {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	for _, entry := range buffer.entries {
+		switch entry.level {
+		case levelError:
+			logger.Errorf("%s", entry.message)
+		case levelVerbose:
+			logger.Verbosef("%s", entry.message)
+		default:
+			logger.Infof("%s", entry.message)
+		}
+	}
+	buffer.entries = nil
+}
@@ -0,0 +1,73 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package build
+
+import (
+	"os"
+	"errors"
+	"syscall"
+)
+
+// Procedure:
+//  mmapRegion
+// Purpose:
+//  To map a region of a file into memory read only
+// Parameters:
+//  The file to map: file *os.File
+//  Where the region starts: offset int64
+//  How long the region is: length int64
+// Produces:
+//  The bytes of the region: data []byte
+//  A function to unmap the region: unmap func() error
+//  Any errors from mmap: err error
+// Preconditions:
+//  length > 0
+// Postconditions:
+//  data stays valid until unmap is called, even if file is closed
+//  err is non-nil if the region runs past the end of file, since
+//    touching mapped pages past the end raises SIGBUS. A file
+//    truncated while mapped can still do that.
+func mmapRegion(file *os.File, offset int64, length int64) (data []byte, unmap func() error, err error) {
+	//mmap offsets have to be page aligned
+	pageSize := int64(os.Getpagesize())
+	alignedOffset := offset - offset%pageSize
+	mapLength := length + offset - alignedOffset
+	if mapLength > maxInt {
+		return nil, nil, errors.New("region too large to map on this platform")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset+length > info.Size() {
+		return nil, nil, errors.New("region runs past the end of the file")
+	}
+	mapped, err := syscall.Mmap(int(file.Fd()), alignedOffset, int(mapLength), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	unmap = func() error {
+		return syscall.Munmap(mapped)
+	}
+	return mapped[offset-alignedOffset:], unmap, nil
+}
@@ -0,0 +1,118 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//The binaries PackAll failed on, and why
+type PackAllError struct {
+	//Keyed by binary path
+	Errors map[string]error
+}
+
+func (packErr *PackAllError) Error() string {
+	binaries := make([]string, 0, len(packErr.Errors))
+	for binary := range packErr.Errors {
+		binaries = append(binaries, binary)
+	}
+	sort.Strings(binaries)
+	reasons := make([]string, len(binaries))
+	for i, binary := range binaries {
+		reasons[i] = fmt.Sprintf("%s: %s", binary, packErr.Errors[binary])
+	}
+	return fmt.Sprintf("failed to pack %d of the binaries: %s", len(binaries), strings.Join(reasons, "; "))
+}
+
+// Procedure:
+//  PackAll
+// Purpose:
+//  To pack the same resources into every binary Build produced
+// Parameters:
+//  The binaries to pack into: binaries []string
+//  The files to pack, keyed by block name: resources map[string]string
+// Produces:
+//  Side effects:
+//    filesystem
+//  A *PackAllError if any binary failed: err error
+// Preconditions:
+//  Every path in resources exists and is readable
+//  No path in resources is one of binaries
+//  Each binary appears once in binaries
+// Postconditions:
+//  Every binary is packed in its own goroutine, each opening the
+//    resource files for itself, in block name order
+//  A binary that fails is left with whatever was appended before
+//    the failure, and its index is still written if possible
+//  The other binaries are unaffected by one failing
+func PackAll(binaries []string, resources map[string]string) error {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := make([]error, len(binaries))
+	var wait sync.WaitGroup
+	for index, binary := range binaries {
+		wait.Add(1)
+		go func(index int, binary string) {
+			defer wait.Done()
+			errs[index] = packOne(binary, names, resources)
+		}(index, binary)
+	}
+	wait.Wait()
+
+	packErr := &PackAllError{Errors: make(map[string]error)}
+	for index, err := range errs {
+		if err != nil {
+			packErr.Errors[binaries[index]] = err
+		}
+	}
+	if len(packErr.Errors) != 0 {
+		return packErr
+	}
+	return nil
+}
+
+//Packs resources into binary under names, in order, for PackAll
+func packOne(binary string, names []string, resources map[string]string) error {
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = appender.AppendNamedFile(name, resources[name])
+		if err != nil {
+			break
+		}
+	}
+	closeErr := appender.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
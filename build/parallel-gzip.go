@@ -0,0 +1,224 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package build
+
+import (
+	"io"
+	"bytes"
+	"sync"
+	"runtime"
+	"compress/gzip"
+)
+
+//Amount of uncompressed data in each gzip member from a parallelGzipWriter
+const parallelChunkSize = 1 << 20
+
+// Type:
+//  parallelGzipWriter
+// Purpose:
+//  To gzip a stream on several cores by compressing fixed size
+//  chunks as separate gzip members and writing them out in order
+// Explicitly implements:
+//  io.Writer
+//  io.Closer
+//  io.WriteCloser
+// Postconditions:
+//  Must be closed to write out the final chunk
+type parallelGzipWriter struct {
+	destination io.Writer
+	buffer      []byte
+	//Whether any chunk has been sent off, so Close knows to
+	//write at least one member for empty streams
+	started bool
+
+	//Result channels of in-flight chunks, in stream order
+	queue chan chan []byte
+	//Limits the number of chunks being compressed at once
+	workers chan struct{}
+	//Closed once the output goroutine has written everything
+	finished chan struct{}
+	//Chunks sent off but not yet written to the destination
+	pending *sync.WaitGroup
+
+	errMux *sync.Mutex
+	err    error
+}
+
+// Procedure:
+//  newParallelGzipWriter
+// Purpose:
+//  To create a parallelGzipWriter
+// Parameters:
+//  Where to write the compressed stream: destination io.Writer
+//  The number of chunks to compress at once: workers int
+// Produces:
+//  writer *parallelGzipWriter
+// Preconditions:
+//  No additional
+// Postconditions:
+//  If workers < 1, runtime.NumCPU() workers are used
+//  The caller closes writer
+func newParallelGzipWriter(destination io.Writer, workers int) *parallelGzipWriter {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	writer := &parallelGzipWriter{
+		destination: destination,
+		buffer:      make([]byte, 0, parallelChunkSize),
+		queue:       make(chan chan []byte, workers),
+		workers:     make(chan struct{}, workers),
+		finished:    make(chan struct{}),
+		errMux:      &sync.Mutex{},
+		pending:     &sync.WaitGroup{},
+	}
+	go writer.writeOut()
+	return writer
+}
+
+//Writes compressed chunks to the destination in the order they were queued
+func (writer *parallelGzipWriter) writeOut() {
+	defer close(writer.finished)
+	for result := range writer.queue {
+		compressed := <-result
+		if writer.getErr() == nil {
+			_, err := writer.destination.Write(compressed)
+			if err != nil {
+				writer.setErr(err)
+			}
+		}
+		writer.pending.Done()
+	}
+}
+
+func (writer *parallelGzipWriter) getErr() error {
+	writer.errMux.Lock()
+	defer writer.errMux.Unlock()
+	return writer.err
+}
+
+func (writer *parallelGzipWriter) setErr(err error) {
+	writer.errMux.Lock()
+	defer writer.errMux.Unlock()
+	if writer.err == nil {
+		writer.err = err
+	}
+}
+
+//Hands the buffered chunk off to be compressed and starts a new buffer
+func (writer *parallelGzipWriter) sendChunk() {
+	chunk := writer.buffer
+	writer.buffer = make([]byte, 0, parallelChunkSize)
+	writer.started = true
+
+	result := make(chan []byte, 1)
+	writer.pending.Add(1)
+	writer.workers <- struct{}{}
+	writer.queue <- result
+	go func() {
+		defer func() { <-writer.workers }()
+		var compressed bytes.Buffer
+		gzWriter := gzip.NewWriter(&compressed)
+		_, err := gzWriter.Write(chunk)
+		if err == nil {
+			err = gzWriter.Close()
+		}
+		if err != nil {
+			writer.setErr(err)
+		}
+		result <- compressed.Bytes()
+	}()
+}
+
+// Procedure:
+//  *parallelGzipWriter.Write
+// Purpose:
+//  To add data to the compressed stream
+// Parameters:
+//  The *parallelGzipWriter being written to: writer
+//  The data to write: p []byte
+// Produces:
+//  The number of bytes accepted: n int
+//  The first error from compressing or writing any chunk: err error
+// Preconditions:
+//  writer has not been closed
+// Postconditions:
+//  See the documentation for io.Writer
+func (writer *parallelGzipWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if err = writer.getErr(); err != nil {
+			return n, err
+		}
+		space := parallelChunkSize - len(writer.buffer)
+		if space > len(p) {
+			space = len(p)
+		}
+		writer.buffer = append(writer.buffer, p[:space]...)
+		p = p[space:]
+		n += space
+		if len(writer.buffer) == parallelChunkSize {
+			writer.sendChunk()
+		}
+	}
+	return n, writer.getErr()
+}
+
+// Procedure:
+//  *parallelGzipWriter.Flush
+// Purpose:
+//  To push everything written so far out to the destination
+// Parameters:
+//  The *parallelGzipWriter being flushed: writer
+// Produces:
+//  The first error from compressing or writing any chunk: err error
+// Preconditions:
+//  writer has not been closed
+// Postconditions:
+//  Any partial chunk is compressed as its own member and every
+//    member so far has been written to the destination
+func (writer *parallelGzipWriter) Flush() error {
+	if len(writer.buffer) > 0 {
+		writer.sendChunk()
+	}
+	writer.pending.Wait()
+	return writer.getErr()
+}
+
+// Procedure:
+//  *parallelGzipWriter.Close
+// Purpose:
+//  To compress the last chunk and wait for everything to be written
+// Parameters:
+//  The *parallelGzipWriter being closed: writer
+// Produces:
+//  The first error from compressing or writing any chunk: err error
+// Preconditions:
+//  Close has not been called
+// Postconditions:
+//  The destination holds one gzip member per chunk, at least one
+//  No goroutines are left running
+func (writer *parallelGzipWriter) Close() error {
+	if len(writer.buffer) > 0 || !writer.started {
+		writer.sendChunk()
+	}
+	close(writer.queue)
+	<-writer.finished
+	return writer.getErr()
+}
@@ -0,0 +1,142 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"io"
+	"bytes"
+	"math/rand"
+	"io/ioutil"
+	"fmt"
+	"runtime"
+	"compress/gzip"
+	"testing"
+)
+
+//Random words, so the data compresses about as well as text does
+func compressibleData(size int) []byte {
+	words := []string{"transcode", "bot", "client", "server", "ffmpeg", "video", "audio", "stream", "\n"}
+	random := rand.New(rand.NewSource(1))
+	var output bytes.Buffer
+	for output.Len() < size {
+		output.WriteString(words[random.Intn(len(words))])
+		output.WriteByte(' ')
+	}
+	return output.Bytes()[:size]
+}
+
+func TestParallelGzipRoundTrips(t *testing.T) {
+	tests := []struct {
+		size    int
+		workers int
+	}{
+		{0, 1},
+		{1, 1},
+		{parallelChunkSize - 1, 2},
+		{parallelChunkSize, 2},
+		{parallelChunkSize + 1, 2},
+		{3*parallelChunkSize + 7, 1},
+		{3*parallelChunkSize + 7, 4},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d bytes on %d workers", test.size, test.workers), func(t *testing.T) {
+			data := compressibleData(test.size)
+			var compressed bytes.Buffer
+			writer := newParallelGzipWriter(&compressed, test.workers)
+			//Odd sized writes so chunks get split across them
+			for remaining := data; len(remaining) > 0; {
+				n := 12345
+				if n > len(remaining) {
+					n = len(remaining)
+				}
+				if _, err := writer.Write(remaining[:n]); err != nil {
+					t.Fatal(err)
+				}
+				remaining = remaining[n:]
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reader, err := gzip.NewReader(&compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(output, data) {
+				t.Errorf("got back %d bytes that don't match the %d written", len(output), len(data))
+			}
+		})
+	}
+}
+
+func TestParallelCompressBlocksExtract(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appender.ParallelCompress = true
+	appender.CompressWorkers = 3
+	data := compressibleData(5*parallelChunkSize + 3)
+	if err = appender.AppendStreamReader("large", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestBlock(t, binary, "large"); content != string(data) {
+		t.Errorf("got back %d bytes that don't match the %d packed", len(content), len(data))
+	}
+}
+
+//Run with -cpu 1,4 or the like to see how the speedup scales with cores;
+//on a single core, parallel compression only adds overhead
+func BenchmarkAppendLargeStream(b *testing.B) {
+	data := compressibleData(32 << 20)
+	for _, parallel := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ParallelCompress=%v", parallel), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for ii := 0; ii < b.N; ii++ {
+				b.StopTimer()
+				appender, err := MakeAppender(testBinary(b))
+				if err != nil {
+					b.Fatal(err)
+				}
+				appender.ParallelCompress = parallel
+				appender.CompressWorkers = runtime.GOMAXPROCS(0)
+				b.StartTimer()
+				//Hide that the source is seekable, as a large stream wouldn't be
+				err = appender.AppendStreamReader("large", io.MultiReader(bytes.NewReader(data)))
+				if err == nil {
+					err = appender.Close()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
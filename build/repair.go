@@ -0,0 +1,279 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package build
+
+import (
+	"os"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"errors"
+)
+
+//Added to the name of a file MakeAppender packs into for the record of
+//what it cut off the file, which lasts until Close writes the new index.
+//The record is the file's length before appending, as a little endian
+//int64, followed by the index and trailer that were cut off, if any.
+const undoSuffix = ".undo"
+
+//Where MakeAppender records how to undo appending to filename
+func undoFilename(filename string) string {
+	return filename + undoSuffix
+}
+
+// Procedure:
+//  writeUndo
+// Purpose:
+//  To record how to put a file back as it was before appending to it
+// Parameters:
+//  The file about to be appended to: fileHandle *os.File
+//  Where the blocks end and the appending will start: length int64
+// Produces:
+//  Any filesystem errors: err error
+// Preconditions:
+//  Nothing past length has been cut off yet
+// Postconditions:
+//  undoFilename(fileHandle.Name()) holds length and everything in the
+//    file past it, and is synced to disk
+//  The record is written to a temporary file and renamed into place,
+//    so it is never seen half written
+func writeUndo(fileHandle *os.File, length int64) error {
+	info, err := fileHandle.Stat()
+	if err != nil {
+		return err
+	}
+	var record bytes.Buffer
+	_ = binary.Write(&record, binary.LittleEndian, length)
+	_, err = io.Copy(&record, io.NewSectionReader(fileHandle, length, info.Size()-length))
+	if err != nil {
+		return err
+	}
+
+	target := undoFilename(fileHandle.Name())
+	tempFile, err := ioutil.TempFile(filepath.Dir(target), filepath.Base(target))
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(record.Bytes())
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), target)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+//Reads what writeUndo recorded for filename, the length to cut the file
+//back to and what to put after it
+func readUndo(filename string) (length int64, tail []byte, err error) {
+	record, err := ioutil.ReadFile(undoFilename(filename))
+	if err != nil {
+		return 0, nil, err
+	}
+	if int64(len(record)) < indexPtrSize {
+		return 0, nil, errors.New(fmt.Sprintf("%s is too short to be an undo record", undoFilename(filename)))
+	}
+	length = int64(binary.LittleEndian.Uint64(record[:indexPtrSize]))
+	if length < 0 {
+		return 0, nil, errors.New(fmt.Sprintf("%s has a negative length", undoFilename(filename)))
+	}
+	return length, record[indexPtrSize:], nil
+}
+
+//Removes the undo record of filename, if there is one
+func removeUndo(filename string) error {
+	err := os.Remove(undoFilename(filename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//Reads tail as though it started offset bytes into a file, for
+//checking a cut off index before putting it back
+type offsetReaderAt struct {
+	data   []byte
+	offset int64
+}
+
+func (reader *offsetReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < reader.offset {
+		return 0, errors.New(fmt.Sprintf("read at %d is before the saved index at %d", off, reader.offset))
+	}
+	return bytes.NewReader(reader.data).ReadAt(p, off-reader.offset)
+}
+
+// Procedure:
+//  RepairArchive
+// Purpose:
+//  To fix a packed file left damaged by an interrupted append
+// Parameters:
+//  The packed file: path string
+// Produces:
+//  Any errors in reading or rewriting the file: err error
+// Preconditions:
+//  path was packed by a BinAppender
+// Postconditions:
+//  If path doesn't end in an index, as when the process died part way
+//    through appending to it, it is put back as it was before the
+//    unfinished append, from what MakeAppender recorded in
+//    $path.undo. Blocks from the unfinished append are dropped.
+//  If path ends in an index, but anything lies between the end of the
+//    last indexed block and the index, it is removed and a clean index
+//    and trailer are written in the same format as before
+//  Before anything is changed, the original is copied to $path.bak,
+//    which must not already exist
+//  Files with nothing to repair are left untouched, with no backup
+//  err is non-nil if path has neither an index nor an undo record,
+//    the undo record doesn't hold a readable index, or an indexed
+//    block runs into the index, since cutting would then lose data
+func RepairArchive(path string) error {
+	fileHandle, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	metadata, metadataPtr, found, err := findExistingMetadata(fileHandle)
+	if err == nil && !found {
+		_ = fileHandle.Close()
+		return undoAppend(path)
+	}
+	var indexTrailer trailer
+	if err == nil {
+		var info os.FileInfo
+		info, err = fileHandle.Stat()
+		if err == nil {
+			indexTrailer, err = readTrailer(fileHandle, info.Size())
+		}
+	}
+	_ = fileHandle.Close()
+	if err != nil {
+		return err
+	}
+
+	//Without any blocks, the index is the only thing known to be good
+	dataEnd := metadataPtr
+	if len(metadata.Data) != 0 {
+		dataEnd = 0
+		for name, data := range metadata.Data {
+			blockEnd := data.StartFilePtr + data.ZippedSize
+			if blockEnd > metadataPtr {
+				return errors.New(fmt.Sprintf("block %s runs into the index of %s", name, path))
+			}
+			if blockEnd > dataEnd {
+				dataEnd = blockEnd
+			}
+		}
+	}
+	if dataEnd == metadataPtr {
+		return nil
+	}
+
+	err = backupArchive(path)
+	if err != nil {
+		return err
+	}
+
+	appender, err := MakeAppender(path)
+	if err != nil {
+		return err
+	}
+	appender.BinaryIndex = indexTrailer.flags&indexFormatMask == indexFormatBinary
+	appender.CompressIndex = indexTrailer.flags&trailerFlagGzip != 0
+	err = appender.truncateTo(dataEnd, nil)
+	closeErr := appender.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+//Copies path to $path.bak before RepairArchive changes it
+func backupArchive(path string) error {
+	backup := path + ".bak"
+	if _, err := os.Stat(backup); err == nil {
+		return errors.New(fmt.Sprintf("backup %s already exists", backup))
+	}
+	return copyFile(path, backup)
+}
+
+//Puts path back as it was before an append that never finished, from
+//its undo record, for RepairArchive
+func undoAppend(path string) error {
+	length, tail, err := readUndo(path)
+	if os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("%s has no index to repair from, and no record of an unfinished append to it", path))
+	} else if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if length > info.Size() {
+		return errors.New(fmt.Sprintf("%s is shorter than it was before the unfinished append", path))
+	}
+	//The file may not have been packed before, in which case there's
+	//no index to put back
+	if len(tail) != 0 {
+		index, _, err := readIndex(&offsetReaderAt{data: tail, offset: length}, length+int64(len(tail)))
+		if err != nil {
+			return errors.New(fmt.Sprintf("index saved in %s is unreadable: %s", undoFilename(path), err))
+		}
+		if _, err = readAllMetadata(index, &offsetReaderAt{data: tail, offset: length}); err != nil {
+			return errors.New(fmt.Sprintf("index saved in %s is unreadable: %s", undoFilename(path), err))
+		}
+	}
+
+	err = backupArchive(path)
+	if err != nil {
+		return err
+	}
+	fileHandle, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = fileHandle.Truncate(length)
+	if err == nil {
+		_, err = fileHandle.WriteAt(tail, length)
+	}
+	if err == nil {
+		err = fileHandle.Sync()
+	}
+	closeErr := fileHandle.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return removeUndo(path)
+}
@@ -0,0 +1,181 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"os"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRepairCutsGarbageBeforeTheIndex(t *testing.T) {
+	binary := testBinary(t)
+	appender, err := MakeAppender(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.AppendStreamReader("block", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	//Left by an append that failed and couldn't be truncated off
+	if _, err = appender.fileHandle.Write(bytes.Repeat([]byte("garbage"), 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err = appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	damaged, err := ioutil.ReadFile(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = RepairArchive(binary); err != nil {
+		t.Fatal(err)
+	}
+	if backup, err := ioutil.ReadFile(binary + ".bak"); err != nil || !bytes.Equal(backup, damaged) {
+		t.Errorf("backup is not the damaged file: %v", err)
+	}
+	repaired, err := ioutil.ReadFile(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(repaired, []byte("garbage")) {
+		t.Error("garbage was left in the repaired file")
+	}
+	if got := readTestBlock(t, binary, "block"); got != "data" {
+		t.Errorf("block is %q", got)
+	}
+
+	//Nothing left to cut, so nothing is done
+	if err = os.Remove(binary + ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if err = RepairArchive(binary); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(binary + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("backed up a file with nothing to repair: %v", err)
+	}
+}
+
+func TestRepairUndoesInterruptedAppends(t *testing.T) {
+	tests := []struct {
+		name string
+		//Packed and closed before the append that's interrupted
+		before map[string]string
+	}{
+		{"packed before", map[string]string{"first": "first"}},
+		{"never packed", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := testBinary(t)
+			if test.before != nil {
+				appender, err := MakeAppender(binary)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for name, content := range test.before {
+					if err = appender.AppendStreamReader(name, strings.NewReader(content)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err = appender.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			original, err := ioutil.ReadFile(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//Stop as a crash would, after the block is written but before
+			//Close writes the index that MakeAppender cut off
+			appender, err := MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.AppendStreamReader("second", strings.NewReader("second")); err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.fileHandle.Close(); err != nil {
+				t.Fatal(err)
+			}
+			interrupted, err := ioutil.ReadFile(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = MakeAppender(binary); err == nil {
+				t.Fatal("appended again without repairing the unfinished append")
+			}
+
+			if err = RepairArchive(binary); err != nil {
+				t.Fatal(err)
+			}
+			if backup, err := ioutil.ReadFile(binary + ".bak"); err != nil || !bytes.Equal(backup, interrupted) {
+				t.Errorf("backup is not the interrupted file: %v", err)
+			}
+			if repaired, err := ioutil.ReadFile(binary); err != nil || !bytes.Equal(repaired, original) {
+				t.Errorf("file is not as it was before the interrupted append: %v", err)
+			}
+			if _, err = os.Stat(binary + undoSuffix); !os.IsNotExist(err) {
+				t.Errorf("undo record left after repairing: %v", err)
+			}
+			for name, content := range test.before {
+				if got := readTestBlock(t, binary, name); got != content {
+					t.Errorf("%s is %q; expected %q", name, got, content)
+				}
+			}
+
+			//Appending carries on from the repaired file
+			appender, err = MakeAppender(binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.AppendStreamReader("second", strings.NewReader("second")); err != nil {
+				t.Fatal(err)
+			}
+			if err = appender.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestBlock(t, binary, "second"); got != "second" {
+				t.Errorf("second is %q", got)
+			}
+			if _, err = os.Stat(binary + undoSuffix); !os.IsNotExist(err) {
+				t.Errorf("undo record left after closing: %v", err)
+			}
+		})
+	}
+}
+
+func TestRepairWithoutIndexOrUndoFails(t *testing.T) {
+	binary := testBinary(t)
+	err := RepairArchive(binary)
+	if err == nil || !strings.Contains(err.Error(), "no index to repair from") {
+		t.Fatalf("expected an error about the missing index, got %v", err)
+	}
+	if _, err = os.Stat(binary + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("backed up a file that couldn't be repaired: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package build
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"strings"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Procedure:
+//  VerifyBinary
+// Purpose:
+//  To check that a downloaded client is exactly what was built
+// Parameters:
+//  The path of the binary: path string
+//  The hex encoded SHA-256 it should have: expectedSHA256 string
+// Produces:
+//  Why the binary doesn't match, if it doesn't: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  The file is streamed through the hash, so it is never all in memory
+//  expectedSHA256 may be upper or lower case, and surrounding
+//    whitespace is ignored, so lines of sha256sum output can be
+//    passed straight in once split
+//  err is non-nil before path is read if expectedSHA256 isn't a
+//    SHA-256 in hex
+//  On a mismatch, err gives both hashes
+func VerifyBinary(path string, expectedSHA256 string) error {
+	expected := strings.ToLower(strings.TrimSpace(expectedSHA256))
+	if decoded, err := hex.DecodeString(expected); err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("%q is not a hex encoded SHA-256", expectedSHA256)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return fmt.Errorf("reading %s: %s", path, err)
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != expected {
+		return fmt.Errorf("%s does not match its checksum: expected sha256 %s, got %s", path, expected, actual)
+	}
+	return nil
+}
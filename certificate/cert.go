@@ -39,22 +39,49 @@ const (
 	rootCertFileName string = "root.crt"
 )
 
+//Subject fields for generated certificates
+//Empty fields are left out, except Organization, which defaults
+//to transcodebot- followed by this machine's hostname
+type Subject struct {
+	CommonName   string
+	Organization string
+	//Two letter ISO 3166 code, e.g. US
+	Country string
+}
+
+//The pkix.Name subject describes, with defaults filled in
+func (subject Subject) pkixName() pkix.Name {
+	name := pkix.Name{CommonName: subject.CommonName}
+	organization := subject.Organization
+	if organization == "" {
+		hostname, _ := os.Hostname()
+		organization = "transcodebot-" + hostname
+	}
+	name.Organization = []string{organization}
+	if subject.Country != "" {
+		name.Country = []string{subject.Country}
+	}
+	return name
+}
+
 //Much here taken from https://ericchiang.github.io/post/go-tls
 
 //Generate server certificate and dump to file
-func GenRootCert(serverIPs []net.IP) {
+//The server's addresses and hostnames are added as IP and DNS SANs
+func GenRootCert(serverIPs []net.IP, serverHosts []string, subject Subject) {
 	common.PrintVerbose("Generating certificates...")
 	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		common.PrintError("certificate key err: ", err)
 	}
 
-	rootCertTmpl := certTemplate()
+	rootCertTmpl := certTemplate(subject)
 
 	rootCertTmpl.IsCA = true
 	rootCertTmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
 	rootCertTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
 	rootCertTmpl.IPAddresses = serverIPs
+	rootCertTmpl.DNSNames = serverHosts
 	_, rootCertPEM := createCert(rootCertTmpl, rootCertTmpl, &rootKey.PublicKey, rootKey)
 
 	writeCertFile(rootCertPEM, rootCertFileName)
@@ -68,6 +95,7 @@ func GenRootCert(serverIPs []net.IP) {
 //  their public keys where the server can find them
 // Parameters:
 //  The name of the client file (sans .crt): name string
+//  The subject of the client certificate: subject Subject
 //  The signing parent certificate: parentCert *x509.Certificate
 //  The signing parent private key: parentKey *rsa.PrivateKey
 // Produces:
@@ -84,12 +112,12 @@ func GenRootCert(serverIPs []net.IP) {
 //  PEMCert is signed by parentCert and parentKey
 //  $settingsDir/cert/$name.crt contains the private certificate
 //  $settingsDir/cert/$name.crt contains the private key file
-func GenClientCert(name string, parentCert *x509.Certificate, parentKey *rsa.PrivateKey) (PEMPrivKey, PEMCert []byte) {
+func GenClientCert(name string, subject Subject, parentCert *x509.Certificate, parentKey *rsa.PrivateKey) (PEMPrivKey, PEMCert []byte) {
 	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		common.PrintError("Key gen err: ", err)
 	}
-	clientTmpl := certTemplate()
+	clientTmpl := certTemplate(subject)
 	clientTmpl.KeyUsage = x509.KeyUsageDigitalSignature
 	clientTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
 	_, PEMCert = createCert(clientTmpl, parentCert, &privKey.PublicKey, parentKey)
@@ -124,7 +152,7 @@ func privateKeyPEMify(privateKey *rsa.PrivateKey) []byte {
 	})
 }
 
-func certTemplate() *x509.Certificate {
+func certTemplate(subject Subject) *x509.Certificate {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 
@@ -132,11 +160,9 @@ func certTemplate() *x509.Certificate {
 		common.PrintError("certificate secure random err: ", err)
 	}
 
-	hostname, err := os.Hostname()
-
 	tmpl := x509.Certificate{
 		SerialNumber:       serialNumber,
-		Subject:            pkix.Name{Organization: []string{"transcodebot-" + hostname}},
+		Subject:            subject.pkixName(),
 		SignatureAlgorithm: x509.SHA256WithRSA,
 		NotBefore:          time.Now(),
 		//*Supposedly* the tls protocol is implemented such that
@@ -0,0 +1,92 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package certificate
+
+import (
+	"net"
+	"fmt"
+	"errors"
+)
+
+//Largest number of addresses a single CIDR may expand to.
+//Every address becomes an IP SAN, so this keeps certificates sane.
+const MaxCIDRAddresses = 1024
+
+// Procedure:
+//  ExpandCIDRs
+// Purpose:
+//  To turn server subnets into the individual addresses to put
+//  in the root certificate
+// Parameters:
+//  The subnets in CIDR notation, i.e. 192.168.1.0/28: cidrs []string
+// Produces:
+//  Every address in every subnet: ips []net.IP
+//  Any parsing or validation errors: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  err is non-nil if any entry doesn't parse, if any two entries
+//    overlap, or if any entry holds more than MaxCIDRAddresses addresses
+//  ips includes the network and broadcast addresses of each subnet
+func ExpandCIDRs(cidrs []string) ([]net.IP, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones > 30 || 1<<uint(bits-ones) > MaxCIDRAddresses {
+			return nil, errors.New(fmt.Sprintf(
+				"%s is too large: more than %d addresses",
+				cidr,
+				MaxCIDRAddresses,
+			))
+		}
+		for _, other := range networks {
+			if other.Contains(network.IP) || network.Contains(other.IP) {
+				return nil, errors.New(fmt.Sprintf("%s overlaps with %s", cidr, other.String()))
+			}
+		}
+		networks = append(networks, network)
+	}
+
+	ips := []net.IP{}
+	for _, network := range networks {
+		for ip := network.IP; network.Contains(ip); ip = nextIP(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+//Returns a copy of ip incremented by one, wrapping around at the top
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for ii := len(next) - 1; ii >= 0; ii-- {
+		next[ii]++
+		if next[ii] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,95 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package certificate
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestExpandCIDRs(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs []string
+		//Every address expected, in order, if checked
+		want []string
+		//How many addresses are expected, if there's no error
+		count int
+		//What the error should mention, "" if there shouldn't be one
+		err string
+	}{
+		{"nothing", nil, nil, 0, ""},
+		{"/30 keeps network and broadcast", []string{"192.168.1.0/30"},
+			[]string{"192.168.1.0", "192.168.1.1", "192.168.1.2", "192.168.1.3"}, 4, ""},
+		{"host bits are ignored", []string{"192.168.1.2/30"},
+			[]string{"192.168.1.0", "192.168.1.1", "192.168.1.2", "192.168.1.3"}, 4, ""},
+		{"/32", []string{"10.0.0.1/32"}, []string{"10.0.0.1"}, 1, ""},
+		//The address after the last one wraps around to 0.0.0.0
+		{"top of the address space", []string{"255.255.255.252/30"},
+			[]string{"255.255.255.252", "255.255.255.253", "255.255.255.254", "255.255.255.255"}, 4, ""},
+		{"separate subnets", []string{"10.0.0.0/30", "10.0.1.0/31"},
+			[]string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.1.0", "10.0.1.1"}, 6, ""},
+		{"/22 is MaxCIDRAddresses", []string{"10.0.0.0/22"}, nil, MaxCIDRAddresses, ""},
+		{"/21 is too large", []string{"10.0.0.0/21"}, nil, 0, "too large"},
+		{"/23 fits", []string{"10.0.0.0/23"}, nil, MaxCIDRAddresses / 2, ""},
+		{"IPv6 /126", []string{"fd00::/126"}, []string{"fd00::", "fd00::1", "fd00::2", "fd00::3"}, 4, ""},
+		//Too big to even shift out the size of
+		{"IPv6 /64", []string{"fd00::/64"}, nil, 0, "too large"},
+		{"IPv6 /0", []string{"::/0"}, nil, 0, "too large"},
+		{"same subnet twice", []string{"10.0.0.0/30", "10.0.0.0/30"}, nil, 0, "overlaps"},
+		{"subnet inside another", []string{"10.0.0.0/24", "10.0.0.4/30"}, nil, 0, "overlaps"},
+		{"subnet around another", []string{"10.0.0.4/30", "10.0.0.0/24"}, nil, 0, "overlaps"},
+		{"adjacent subnets", []string{"10.0.0.0/30", "10.0.0.4/30"}, nil, 8, ""},
+		{"not a CIDR", []string{"10.0.0.1"}, nil, 0, "invalid CIDR"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ips, err := ExpandCIDRs(test.cidrs)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error about %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != test.count {
+				t.Fatalf("expanded to %d addresses, expected %d", len(ips), test.count)
+			}
+			for ii, want := range test.want {
+				if !ips[ii].Equal(net.ParseIP(want)) {
+					t.Errorf("address %d is %s, expected %s", ii, ips[ii], want)
+				}
+			}
+			//No address comes out twice
+			seen := map[string]bool{}
+			for _, ip := range ips {
+				if seen[ip.String()] {
+					t.Errorf("%s expanded more than once", ip)
+				}
+				seen[ip.String()] = true
+			}
+		})
+	}
+}
@@ -31,7 +31,16 @@ import (
 )
 //gobuffalo/packr for files
 
+//Passed by build.BuildSettings.SmokeTest to check that the binary starts
+const selfTestFlag = "--selftest"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == selfTestFlag {
+		//Getting here means the binary linked and its runtime started
+		log.Println("selftest ok")
+		return
+	}
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
@@ -21,17 +21,33 @@
 package cmd
 
 import (
+	"fmt"
+	"errors"
+	"strings"
+	"net"
+	"os"
+	"path"
+	"unicode"
+
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	"github.com/yourfin/transcodebot/common"
 	"github.com/yourfin/transcodebot/build"
+	cert "github.com/yourfin/transcodebot/certificate"
 )
 
 // buildCmd represents the build command
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "build client binaries",
-	Long: `Build client binaries for target platforms`,
+	Long: `Build client binaries for target platforms
+
+The output prefix and directory come from, in order of precedence:
+--output-prefix and --output-dir, then the config file's output-prefix
+and output-dir, then the TRANSCODEBOT_OUTPUT_PREFIX and
+TRANSCODEBOT_OUTPUT_DIR environment variables, then the built in
+defaults.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var err error
 		if len(args) != 0 {
@@ -39,7 +55,24 @@ var buildCmd = &cobra.Command{
 			common.PrintError("`transcodebot build` does not take any arguments")
 		}
 
-		buildSettings = finalizeBuildSettings(buildSettings)
+		if listTargets {
+			for _, target := range common.SupportedSystemTypes() {
+				fmt.Println(target.OS.ToString() + "/" + target.Arch.ToString())
+			}
+			return
+		}
+
+		if buildConfigFile != "" {
+			buildSettings, err = applyBuildConfig(cmd, buildConfigFile, buildSettings)
+			if err != nil {
+				common.PrintError("Invalid build config " + buildConfigFile + ":\n" + err.Error())
+			}
+		}
+
+		buildSettings, err = finalizeBuildSettings(buildSettings)
+		if err != nil {
+			common.PrintError("Invalid build settings:\n" + err.Error())
+		}
 
 		if err = build.Build(buildSettings); err != nil {
 			common.PrintError("build err: ", err)
@@ -47,25 +80,379 @@ var buildCmd = &cobra.Command{
 	},
 }
 
-var buildSettings build.BuildSettings
+var (
+	buildSettings build.BuildSettings
+	//Subnets to expand into buildSettings.ServerIPs
+	serverCIDRs []string
+	//File to read build settings from, see applyBuildConfig
+	buildConfigFile string
+	//os/arch strings to parse into buildSettings.Targets
+	targetStrings []string
+	//Print the supported targets instead of building
+	listTargets bool
+	//os/arch patterns to narrow the targets down to for this build
+	onlyPatterns []string
+)
+
+//Built in defaults for --output-prefix and --output-dir, which the
+//environment variables below override. An empty --output-dir means
+//the clients directory in the settings dir.
+const (
+	defaultOutputPrefix = "transcode-client-"
+	outputPrefixEnv = "TRANSCODEBOT_OUTPUT_PREFIX"
+	outputDirEnv = "TRANSCODEBOT_OUTPUT_DIR"
+)
+
+//The value of the environment variable key, or fallback if it is unset or empty
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
 
 func init() {
 	rootCmd.AddCommand(buildCmd)
 
 	// Configuration flags
-	buildCmd.PersistentFlags().StringVar(&buildSettings.OutputPrefix, "output-prefix", "trancode-client-", "The start of the binary names")
+	//Read into the flag defaults, so flags and the config file still win
+	buildCmd.PersistentFlags().StringVar(&buildSettings.OutputPrefix, "output-prefix", envOr(outputPrefixEnv, defaultOutputPrefix), "The start of the binary names. Overrides $" + outputPrefixEnv)
+	buildCmd.PersistentFlags().StringVar(&buildSettings.OutputDir, "output-dir", envOr(outputDirEnv, ""), "Directory to put the built clients in. (Default: $" + outputDirEnv + ", or the clients directory in the settings dir)")
 	buildCmd.PersistentFlags().BoolVarP(&buildSettings.NoCompress, "no-compress", "Z", false, "Don't zip binaries")
+	buildCmd.PersistentFlags().BoolVar(&buildSettings.Clean, "clean", false, "Remove binaries in the build dir for targets that are no longer built")
+	buildCmd.PersistentFlags().BoolVar(&buildSettings.DryRun, "dry-run", false, "Print the go build command for each target instead of running it")
 	buildCmd.PersistentFlags().BoolVar(&buildSettings.ForceNewCert, "force-new-certificate", false, "Force a new server SSL certificate to be generated. Invalidates all previous clients.")
+	buildCmd.PersistentFlags().IPSliceVar(&buildSettings.ServerIPs, "server-ip", nil, "IP address the server can be reached at. May be repeated.")
+	cidrHelp := fmt.Sprintf("Subnet the server can be reached from, i.e. 192.168.1.0/28. May be repeated. At most %d addresses each.", cert.MaxCIDRAddresses)
+	buildCmd.PersistentFlags().StringSliceVar(&serverCIDRs, "server-cidr", nil, cidrHelp)
+	buildCmd.PersistentFlags().StringSliceVar(&buildSettings.ServerHosts, "server-host", nil, "Hostname the server can be reached at. May be repeated.")
+	buildCmd.PersistentFlags().StringVar(&buildSettings.CertSubject.CommonName, "cert-common-name", "", "Common name for generated certificates")
+	buildCmd.PersistentFlags().StringVar(&buildSettings.CertSubject.Organization, "cert-organization", "", "Organization for generated certificates. (Default: transcodebot-<hostname>)")
+	buildCmd.PersistentFlags().StringVar(&buildSettings.CertSubject.Country, "cert-country", "", "Two letter country code for generated certificates, i.e. US")
+	buildCmd.PersistentFlags().StringSliceVar(&targetStrings, "target", nil, "os/arch to build a client for, i.e. linux/amd64. May be repeated. (Default: this machine)")
+	buildCmd.PersistentFlags().StringVar(&buildSettings.ClientSourceDir, "client-dir", "", "Directory of the client source to build in. (Default: $GOPATH/src/github.com/yourfin/transcodebot/client)")
+	buildCmd.PersistentFlags().StringVar(&buildSettings.ClientImportPath, "client-import-path", "", "Import path of the client package to build from the current directory, e.g. inside a module. Overrides --client-dir.")
+	buildCmd.PersistentFlags().BoolVar(&buildSettings.MacUniversal, "mac-universal", false, "Also build darwin/amd64 and darwin/arm64 and combine them with lipo into one universal binary")
+	buildCmd.PersistentFlags().BoolVar(&buildSettings.SmokeTest, "smoke-test", false, "Run the client built for this machine with --selftest and fail if it doesn't exit cleanly")
+	buildCmd.PersistentFlags().StringVar(&buildSettings.BuildMode, "buildmode", "", "Build instrumented or hardened clients: race, msan, or a go -buildmode such as pie")
+	buildCmd.PersistentFlags().StringVar(&buildSettings.GoFlags, "goflags", "", "GOFLAGS for go build, e.g. -mod=vendor to build offline")
+	buildCmd.PersistentFlags().StringVar(&buildSettings.GoProxy, "goproxy", "", "GOPROXY for go build, e.g. an internal module proxy")
+	buildCmd.PersistentFlags().BoolVar(&buildSettings.Vendor, "vendor", false, "Build from the client module's vendor directory, failing if it has none. (Default: only if it has one)")
+	buildCmd.PersistentFlags().StringArrayVar(&buildSettings.Env, "env", nil, "KEY=value to set for go build on every target, overriding --goflags and --goproxy. May be repeated.")
+	buildCmd.PersistentFlags().IntVar(&buildSettings.Retries, "retries", 0, "Times to retry a target whose go build fails, e.g. from fetching modules")
+	buildCmd.PersistentFlags().StringSliceVar(&onlyPatterns, "only", nil, "os/arch pattern, i.e. linux/*, to build just the matching targets this time. May be repeated.")
+	buildCmd.PersistentFlags().BoolVar(&listTargets, "list-targets", false, "Print the os/arch combinations --target accepts and exit")
+	buildCmd.PersistentFlags().StringVar(&buildConfigFile, "config", "", "YAML, JSON, or TOML file of build settings. Keys match the flag names, plus targets. Flags override it.")
+}
+
+//Keys that may appear in a build config file
+var buildConfigKeys = []string{
+	"output-prefix",
+	"output-dir",
+	"no-compress",
+	"clean",
+	"force-new-certificate",
+	"server-ip",
+	"server-cidr",
+	"server-host",
+	"cert-common-name",
+	"cert-organization",
+	"cert-country",
+	"client-dir",
+	"client-import-path",
+	"retries",
+	"smoke-test",
+	"mac-universal",
+	"buildmode",
+	"goflags",
+	"goproxy",
+	"vendor",
+	"env",
+	"targets",
+}
+
+// Procedure:
+//  applyBuildConfig
+// Purpose:
+//  To fill in build settings from a config file
+// Parameters:
+//  The build command, to check which flags were set: cmd *cobra.Command
+//  The path of the config file: filename string
+//  The settings from the flags: settings build.BuildSettings
+// Produces:
+//  The settings with the config applied: output build.BuildSettings
+//  Every problem found with the file: err error
+// Preconditions:
+//  Flags have been parsed
+// Postconditions:
+//  Values from flags that were given on the command line are kept
+//  Unknown keys are reported as errors rather than ignored
+//  targets is a list of os/arch strings, e.g. linux/amd64
+func applyBuildConfig(cmd *cobra.Command, filename string, settings build.BuildSettings) (build.BuildSettings, error) {
+	config := viper.New()
+	config.SetConfigFile(filename)
+	if err := config.ReadInConfig(); err != nil {
+		return settings, err
+	}
+
+	var problems settingsErrors
+	for _, key := range config.AllKeys() {
+		known := false
+		for _, knownKey := range buildConfigKeys {
+			known = known || key == knownKey
+		}
+		if !known {
+			problems = append(problems, fmt.Errorf("unknown key %q", key))
+		}
+	}
+
+	//Only use the config for flags that weren't given
+	useConfig := func(key string) bool {
+		return config.IsSet(key) && !cmd.Flags().Changed(key)
+	}
+	if useConfig("output-prefix") {
+		settings.OutputPrefix = config.GetString("output-prefix")
+	}
+	if useConfig("output-dir") {
+		settings.OutputDir = config.GetString("output-dir")
+	}
+	if useConfig("no-compress") {
+		settings.NoCompress = config.GetBool("no-compress")
+	}
+	if useConfig("clean") {
+		settings.Clean = config.GetBool("clean")
+	}
+	if useConfig("force-new-certificate") {
+		settings.ForceNewCert = config.GetBool("force-new-certificate")
+	}
+	if useConfig("server-ip") {
+		settings.ServerIPs = nil
+		for _, ipString := range config.GetStringSlice("server-ip") {
+			serverIP := net.ParseIP(ipString)
+			if serverIP == nil {
+				problems = append(problems, fmt.Errorf("server-ip: %q is not an IP address", ipString))
+			} else {
+				settings.ServerIPs = append(settings.ServerIPs, serverIP)
+			}
+		}
+	}
+	if useConfig("server-cidr") {
+		serverCIDRs = config.GetStringSlice("server-cidr")
+	}
+	if useConfig("server-host") {
+		settings.ServerHosts = config.GetStringSlice("server-host")
+	}
+	if useConfig("cert-common-name") {
+		settings.CertSubject.CommonName = config.GetString("cert-common-name")
+	}
+	if useConfig("cert-organization") {
+		settings.CertSubject.Organization = config.GetString("cert-organization")
+	}
+	if useConfig("cert-country") {
+		settings.CertSubject.Country = config.GetString("cert-country")
+	}
+	if useConfig("client-dir") {
+		settings.ClientSourceDir = config.GetString("client-dir")
+	}
+	if useConfig("client-import-path") {
+		settings.ClientImportPath = config.GetString("client-import-path")
+	}
+	if useConfig("mac-universal") {
+		settings.MacUniversal = config.GetBool("mac-universal")
+	}
+	if useConfig("smoke-test") {
+		settings.SmokeTest = config.GetBool("smoke-test")
+	}
+	if useConfig("buildmode") {
+		settings.BuildMode = config.GetString("buildmode")
+	}
+	if useConfig("goflags") {
+		settings.GoFlags = config.GetString("goflags")
+	}
+	if useConfig("goproxy") {
+		settings.GoProxy = config.GetString("goproxy")
+	}
+	if useConfig("vendor") {
+		settings.Vendor = config.GetBool("vendor")
+	}
+	if useConfig("env") {
+		settings.Env = config.GetStringSlice("env")
+	}
+	if useConfig("retries") {
+		settings.Retries = config.GetInt("retries")
+	}
+	if config.IsSet("targets") && !cmd.Flags().Changed("target") {
+		settings.Targets = nil
+		for _, targetString := range config.GetStringSlice("targets") {
+			target, err := common.ParseSystemType(targetString)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("targets: %s", err))
+			} else {
+				settings.Targets = append(settings.Targets, target)
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		return settings, problems
+	}
+	return settings, nil
 }
 
-func finalizeBuildSettings(settings build.BuildSettings) build.BuildSettings {
+//Every problem found with a set of build settings
+type settingsErrors []error
 
-	//Temporary
-	settings.Targets = []common.SystemType{
-		common.SystemType{common.Linux, common.Amd64},
-		common.SystemType{common.Windows, common.Amd64},
-		common.SystemType{common.Windows, common.I386},
+func (errs settingsErrors) Error() string {
+	messages := make([]string, len(errs))
+	for ii, err := range errs {
+		messages[ii] = " - " + err.Error()
 	}
+	return strings.Join(messages, "\n")
+}
 
-	return settings
+// Procedure:
+//  finalizeBuildSettings
+// Purpose:
+//  To fill in and validate the build settings from the command line
+// Parameters:
+//  The settings from the flags: settings build.BuildSettings
+// Produces:
+//  The settings to build with: output build.BuildSettings
+//  Every problem found with the settings: err error
+// Preconditions:
+//  Flags have been parsed
+// Postconditions:
+//  err is nil, or a settingsErrors listing all problems, not just the first
+//  Control characters are stripped from output.OutputPrefix
+//  output.Targets is narrowed down to those matching --only, if given
+func finalizeBuildSettings(settings build.BuildSettings) (build.BuildSettings, error) {
+	var problems settingsErrors
+
+	cidrIPs, err := cert.ExpandCIDRs(serverCIDRs)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("--server-cidr: %s", err))
+	}
+	for _, cidrIP := range cidrIPs {
+		duplicate := false
+		for _, serverIP := range settings.ServerIPs {
+			duplicate = duplicate || serverIP.Equal(cidrIP)
+		}
+		if !duplicate {
+			settings.ServerIPs = append(settings.ServerIPs, cidrIP)
+		}
+	}
+	for _, serverIP := range settings.ServerIPs {
+		if serverIP.IsUnspecified() {
+			problems = append(problems, fmt.Errorf("--server-ip: %s is not an address clients can connect to", serverIP))
+		}
+	}
+	for _, serverHost := range settings.ServerHosts {
+		if strings.TrimSpace(serverHost) == "" {
+			problems = append(problems, errors.New("--server-host: hostnames cannot be empty"))
+		}
+	}
+	if settings.ForceNewCert && len(settings.ServerIPs) == 0 && len(settings.ServerHosts) == 0 {
+		problems = append(problems, errors.New("--force-new-certificate needs at least one --server-ip, --server-cidr, or --server-host"))
+	}
+
+	//Country is a PrintableString of exactly two letters in certificates
+	if country := settings.CertSubject.Country; country != "" {
+		valid := len(country) == 2
+		for _, char := range country {
+			valid = valid && (char >= 'A' && char <= 'Z' || char >= 'a' && char <= 'z')
+		}
+		if !valid {
+			problems = append(problems, fmt.Errorf("--cert-country %q is not a two letter country code", country))
+		} else {
+			settings.CertSubject.Country = strings.ToUpper(country)
+		}
+	}
+
+	//Control characters are never wanted in a filename, and some
+	//filesystems refuse them outright
+	settings.OutputPrefix = strings.Map(func(char rune) rune {
+		if unicode.IsControl(char) {
+			return -1
+		}
+		return char
+	}, settings.OutputPrefix)
+	if strings.TrimSpace(settings.OutputPrefix) == "" {
+		problems = append(problems, errors.New("--output-prefix cannot be empty"))
+	} else if separator := strings.IndexAny(settings.OutputPrefix, `/\`); separator != -1 {
+		problems = append(problems, fmt.Errorf("--output-prefix %q cannot contain the path separator %q",
+			settings.OutputPrefix, settings.OutputPrefix[separator]))
+	}
+
+	if err := build.ValidateBuildMode(settings.BuildMode); err != nil {
+		problems = append(problems, fmt.Errorf("--buildmode: %s", err))
+	}
+
+	for _, entry := range settings.Env {
+		if key, _, ok := splitAssignment(entry); !ok || key == "" {
+			problems = append(problems, fmt.Errorf("--env %q is not of the form KEY=value", entry))
+		}
+	}
+
+	if settings.Retries < 0 {
+		problems = append(problems, fmt.Errorf("--retries %d cannot be negative", settings.Retries))
+	}
+
+	if len(targetStrings) != 0 {
+		settings.Targets = nil
+		for _, targetString := range targetStrings {
+			target, err := common.ParseSystemType(targetString)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("--target: %s", err))
+			} else {
+				settings.Targets = append(settings.Targets, target)
+			}
+		}
+	} else if len(settings.Targets) == 0 {
+		//Nothing from the flags or config, so build something that runs here
+		settings.Targets = []common.SystemType{common.HostSystemType()}
+	}
+	if len(settings.Targets) == 0 {
+		problems = append(problems, errors.New("no targets to build"))
+	}
+	if len(onlyPatterns) != 0 {
+		only, err := filterTargets(settings.Targets, onlyPatterns)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("--only: %s", err))
+		} else if len(only) == 0 && len(settings.Targets) != 0 {
+			problems = append(problems, fmt.Errorf("--only %s matches none of the targets", strings.Join(onlyPatterns, ",")))
+		} else {
+			settings.Targets = only
+		}
+	}
+	//Checked here too so it's reported alongside everything else,
+	//rather than once the build starts
+	if err := build.ValidateDetectorTargets(settings.BuildMode, settings.Targets); err != nil {
+		problems = append(problems, fmt.Errorf("--buildmode: %s", err))
+	}
+
+	if len(problems) != 0 {
+		return settings, problems
+	}
+	return settings, nil
+}
+
+//The targets matching any of patterns, which are os/arch globs in
+//path.Match syntax, e.g. linux/* or */amd64
+func filterTargets(targets []common.SystemType, patterns []string) ([]common.SystemType, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %s", pattern, err)
+		}
+	}
+	var matched []common.SystemType
+	for _, target := range targets {
+		name := target.OS.ToString() + "/" + target.Arch.ToString()
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = append(matched, target)
+				break
+			}
+		}
+	}
+	return matched, nil
 }
@@ -0,0 +1,116 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+
+package cmd
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/yourfin/transcodebot/build"
+	"github.com/yourfin/transcodebot/common"
+)
+
+func TestFilterTargets(t *testing.T) {
+	targets := []common.SystemType{
+		{OS: common.Linux, Arch: common.Amd64},
+		{OS: common.Linux, Arch: common.Arm64},
+		{OS: common.Windows, Arch: common.Amd64},
+	}
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+		//What the error should mention, "" if there shouldn't be one
+		err string
+	}{
+		{"exact", []string{"linux/arm64"}, []string{"linux/arm64"}, ""},
+		{"any arch", []string{"linux/*"}, []string{"linux/amd64", "linux/arm64"}, ""},
+		{"any os", []string{"*/amd64"}, []string{"linux/amd64", "windows/amd64"}, ""},
+		{"several, in target order", []string{"windows/*", "linux/amd64"}, []string{"linux/amd64", "windows/amd64"}, ""},
+		{"matching twice counts once", []string{"linux/*", "*/amd64"}, []string{"linux/amd64", "linux/arm64", "windows/amd64"}, ""},
+		{"nothing matches", []string{"darwin/*"}, nil, ""},
+		{"bad pattern", []string{"linux/["}, nil, "bad pattern"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matched, err := filterTargets(targets, test.patterns)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error about %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, target := range matched {
+				got = append(got, target.OS.ToString() + "/" + target.Arch.ToString())
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("matched %v, expected %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFinalizeBuildSettingsServerCIDRs(t *testing.T) {
+	defer func(saved []string) { serverCIDRs = saved }(serverCIDRs)
+	tests := []struct {
+		name      string
+		cidrs     []string
+		serverIPs []net.IP
+		//How many server addresses there should be, if there's no error
+		count int
+		//What the error should mention, "" if there shouldn't be one
+		err string
+	}{
+		{"expanded into the server addresses", []string{"10.0.0.0/30"}, nil, 4, ""},
+		{"addresses already given aren't repeated", []string{"10.0.0.0/30"}, []net.IP{net.ParseIP("10.0.0.1")}, 4, ""},
+		{"kept alongside other addresses", []string{"10.0.0.0/30"}, []net.IP{net.ParseIP("10.0.1.1")}, 5, ""},
+		{"overlapping", []string{"10.0.0.0/24", "10.0.0.4/30"}, nil, 0, "--server-cidr: 10.0.0.4/30 overlaps"},
+		{"too large", []string{"fd00::/64"}, nil, 0, "--server-cidr: fd00::/64 is too large"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverCIDRs = test.cidrs
+			settings, err := finalizeBuildSettings(build.BuildSettings{
+				OutputPrefix: "client-",
+				ServerIPs:    test.serverIPs,
+				Targets:      []common.SystemType{common.HostSystemType()},
+			})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error about %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(settings.ServerIPs) != test.count {
+				t.Errorf("server addresses are %v, expected %d of them", settings.ServerIPs, test.count)
+			}
+		})
+	}
+}
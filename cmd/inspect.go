@@ -0,0 +1,186 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+	"fmt"
+	"encoding/json"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/yourfin/transcodebot/common"
+	"github.com/yourfin/transcodebot/build"
+)
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <file>",
+	Short: "list the data packed into a client binary",
+	Long: `List the version and every block appended to a packed client binary,
+along with where each block sits and how much space the packing takes up.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			common.PrintError("`transcodebot inspect` takes exactly one file")
+		}
+		if inspectManifest {
+			printManifest(args[0])
+			return
+		}
+		report, err := inspectFile(args[0])
+		if err != nil {
+			common.PrintError("inspect err: ", err)
+		}
+		if inspectJSON {
+			encoded, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				common.PrintError("encoding json err: ", err)
+			}
+			fmt.Println(string(encoded))
+		} else {
+			report.print()
+		}
+	},
+}
+
+var (
+	//Emit machine readable output
+	inspectJSON bool
+	//Print hashes of every block instead of the layout
+	inspectManifest bool
+	//Hash to use for the manifest
+	inspectManifestHash string
+)
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().BoolVar(&inspectJSON, "json", false, "Print the listing as json")
+	inspectCmd.Flags().BoolVar(&inspectManifest, "manifest", false, "Print the name, sizes, and SHA-256 of every block as json, for SBOM tooling")
+	inspectCmd.Flags().StringVar(&inspectManifestHash, "manifest-hash", string(build.HashSHA256), "Hash for --manifest to use: sha256, blake3, or crc32")
+}
+
+//Prints the json manifest of filename, reading every block
+func printManifest(filename string) {
+	extractor, err := build.MakeAppendExtractor(filename)
+	if err != nil {
+		common.PrintError("inspect err: ", err)
+	}
+	manifest, err := extractor.ManifestWithHash(build.HashAlgo(inspectManifestHash))
+	if err != nil {
+		common.PrintError("manifest err: ", err)
+	}
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		common.PrintError("encoding json err: ", err)
+	}
+	fmt.Println(string(encoded))
+}
+
+//Everything inspect reports about a packed file
+type inspectReport struct {
+	File string `json:"file"`
+	build.ArchiveMetadata
+	//Size of the whole file on disk
+	FileSize int64 `json:"file_size"`
+	//Sum of the sizes of the blocks as stored
+	BlocksSize int64 `json:"blocks_size"`
+	//Bytes taken by the index and trailer
+	IndexSize int64 `json:"index_size"`
+	//Bytes added by packing, blocks and index together
+	Overhead int64 `json:"overhead"`
+}
+
+// Procedure:
+//  inspectFile
+// Purpose:
+//  To describe the packed data in a file
+// Parameters:
+//  The path to the packed file: filename string
+// Produces:
+//  The description of the file: report inspectReport
+//  Any errors opening or reading the index: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  The file is not modified
+func inspectFile(filename string) (report inspectReport, err error) {
+	report.File = filename
+	info, err := os.Stat(filename)
+	if err != nil {
+		return report, err
+	}
+	report.FileSize = info.Size()
+
+	extractor, err := build.MakeAppendExtractor(filename)
+	if err != nil {
+		return report, err
+	}
+	report.ArchiveMetadata, err = extractor.Metadata()
+	if err != nil {
+		return report, err
+	}
+
+	//Blocks are appended back to back and the index follows the last one
+	var blocksEnd int64
+	payloadStart := report.FileSize
+	for _, block := range report.Blocks {
+		report.BlocksSize += block.ZippedSize
+		if block.StartFilePtr < payloadStart {
+			payloadStart = block.StartFilePtr
+		}
+		if end := block.StartFilePtr + block.ZippedSize; end > blocksEnd {
+			blocksEnd = end
+		}
+	}
+	if len(report.Blocks) != 0 {
+		report.IndexSize = report.FileSize - blocksEnd
+		report.Overhead = report.FileSize - payloadStart
+	}
+	return report, nil
+}
+
+//Prints report as a table, like unzip -l
+func (report inspectReport) print() {
+	fmt.Println("File:", report.File)
+	fmt.Println("Version:", report.Version)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "Offset\tStored size\tSize\tRatio\tMethod\t  Name")
+	for _, block := range report.Blocks {
+		method := block.Framing
+		if block.Stored {
+			method = "stored"
+		}
+		size := "-"
+		ratio := "-"
+		if block.UnzippedSize != 0 || block.Stored {
+			size = fmt.Sprint(block.UnzippedSize)
+		}
+		if block.Ratio != 0 {
+			ratio = fmt.Sprintf("%.1f%%", 100*block.Ratio)
+		}
+		fmt.Fprintf(writer, "%d\t%d\t%s\t%s\t%s\t  %s\n", block.StartFilePtr, block.ZippedSize, size, ratio, method, block.Name)
+	}
+	_ = writer.Flush()
+	fmt.Printf("%d blocks, %d bytes of blocks, %d bytes of index\n", len(report.Blocks), report.BlocksSize, report.IndexSize)
+	fmt.Printf("%d of %d bytes added by packing\n", report.Overhead, report.FileSize)
+}
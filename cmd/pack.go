@@ -0,0 +1,172 @@
+// Copyright © 2018 Patrick Nuckolls <nuckollsp at gmail>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"fmt"
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/yourfin/transcodebot/common"
+	"github.com/yourfin/transcodebot/build"
+)
+
+// packCmd represents the pack command
+var packCmd = &cobra.Command{
+	Use:   "pack <binary>",
+	Short: "pack files onto the end of a binary",
+	Long: `Append files to a binary so they can be read back out at run time.
+Files already packed into the binary are kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			common.PrintError("`transcodebot pack` takes exactly one binary")
+		}
+		if len(packFiles) == 0 && len(packDirs) == 0 && len(packStdin) == 0 {
+			common.PrintError("Nothing to pack, use --add, --add-dir, or --add-stdin")
+		}
+		if err := packBinary(args[0]); err != nil {
+			common.PrintError("pack err: ", err)
+		}
+	},
+}
+
+var (
+	//name=path pairs to append
+	packFiles []string
+	//[prefix=]dir directories to append
+	packDirs []string
+	//Name to append stdin under. A slice only so that giving it
+	//twice can be caught.
+	packStdin []string
+	//Store files without compressing them
+	packFast bool
+	//Globs of files to skip in, or only take from, packDirs
+	packExcludes []string
+	packIncludes []string
+)
+
+func init() {
+	rootCmd.AddCommand(packCmd)
+
+	packCmd.Flags().StringArrayVar(&packFiles, "add", nil, "name=path of a file to pack under name. May be repeated.")
+	packCmd.Flags().BoolVar(&packFast, "fast", false, "Store files without compressing them. Much faster, but bigger.")
+	packCmd.Flags().StringArrayVar(&packDirs, "add-dir", nil, "[prefix=]dir of a directory to pack, named by path relative to dir. May be repeated.")
+	packCmd.Flags().StringArrayVar(&packStdin, "add-stdin", nil, "name to pack everything read from stdin under, e.g. for generating and packing in one pipe")
+	packCmd.Flags().StringArrayVar(&packExcludes, "exclude", nil, "Glob of files or directories to skip in --add-dir, e.g. .git or *.tmp. May be repeated.")
+	packCmd.Flags().StringArrayVar(&packIncludes, "include", nil, "Glob of the only files to take from --add-dir, e.g. *.png. May be repeated.")
+}
+
+//Splits name=value, with ok false if there is no =
+func splitAssignment(assignment string) (name string, value string, ok bool) {
+	parts := strings.SplitN(assignment, "=", 2)
+	if len(parts) != 2 {
+		return "", assignment, false
+	}
+	return parts[0], parts[1], true
+}
+
+// Procedure:
+//  packBinary
+// Purpose:
+//  To append the files from the pack flags to a binary
+// Parameters:
+//  The binary to append to: binary string
+// Produces:
+//  Any errors in parsing the flags or appending: err error
+// Preconditions:
+//  Flags have been parsed
+// Postconditions:
+//  The flags are all checked before binary is touched
+//  On an interrupt, the block being packed is dropped and the ones
+//    already packed are kept, with the index written as usual
+//  The size growth of binary is printed
+func packBinary(binary string) error {
+	for _, packFile := range packFiles {
+		name, path, ok := splitAssignment(packFile)
+		if !ok || name == "" || path == "" {
+			return fmt.Errorf("--add %q is not of the form name=path", packFile)
+		}
+	}
+	if len(packStdin) > 1 {
+		return fmt.Errorf("--add-stdin given %d times, but stdin can only be read once", len(packStdin))
+	}
+	if len(packStdin) == 1 && packStdin[0] == "" {
+		return fmt.Errorf("--add-stdin needs a name")
+	}
+
+	before, err := os.Stat(binary)
+	if err != nil {
+		return err
+	}
+	appender, err := build.MakeAppender(binary)
+	if err != nil {
+		return err
+	}
+	appender.FastPack = packFast
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for _, packFile := range packFiles {
+		name, path, _ := splitAssignment(packFile)
+		if err = appender.AppendNamedFileContext(ctx, name, path); err != nil {
+			_ = appender.Close()
+			return err
+		}
+	}
+	for _, packDir := range packDirs {
+		prefix, dir, _ := splitAssignment(packDir)
+		if err = appender.AppendDirFilteredContext(ctx, dir, prefix, packIncludes, packExcludes); err != nil {
+			_ = appender.Close()
+			return err
+		}
+	}
+	//The size isn't known up front, the appender counts it as it compresses
+	for _, name := range packStdin {
+		if err = appender.AppendStreamReaderContext(ctx, name, os.Stdin); err != nil {
+			_ = appender.Close()
+			return err
+		}
+	}
+	if err = appender.Close(); err != nil {
+		return err
+	}
+
+	after, err := os.Stat(binary)
+	if err != nil {
+		return err
+	}
+	common.Println(fmt.Sprintf("%s grew by %d bytes, from %d to %d", binary, after.Size()-before.Size(), before.Size(), after.Size()))
+	return nil
+}
@@ -24,6 +24,8 @@ import (
 	"os"
 	"log"
 	"fmt"
+	"strings"
+	"runtime"
 )
 
 //Operating system name type
@@ -49,6 +51,38 @@ func (system SystemType) ToString() string {
 	return system.OS.ToString() + "-" + system.Arch.ToString()
 }
 
+//The system this binary is running on
+func HostSystemType() SystemType {
+	return SystemType{OS: OS(runtime.GOOS), Arch: Arch(runtime.GOARCH)}
+}
+
+// Procedure:
+//  ParseSystemType
+// Purpose:
+//  To read a SystemType back out of a string
+// Parameters:
+//  The string to parse: input string
+// Produces:
+//  The system named by input: system SystemType
+//  An error if input isn't of the form os/arch or os-arch: err error
+// Preconditions:
+//  No additional
+// Postconditions:
+//  ParseSystemType(system.ToString()) == system
+//  The os and arch are not checked against what Go can target
+func ParseSystemType(input string) (system SystemType, err error) {
+	parts := strings.Split(input, "/")
+	if len(parts) != 2 {
+		parts = strings.Split(input, "-")
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return system, fmt.Errorf("%q is not of the form os/arch", input)
+	}
+	system.OS = OS(parts[0])
+	system.Arch = Arch(parts[1])
+	return system, nil
+}
+
 // Settings to pass to ffmpeg to use for transcoding
 // Most of these settings line up with something in the ffmeg documentation, and
 type TranscodeSettings struct {
@@ -86,15 +120,56 @@ type TranscodeSettings struct {
 	SubtitleCodec string
 }
 
-// Any additional architectures/OS's need to be added here
+// Any additional architectures/OS's need to be added here,
+// and to allOSes or allArches below
 const (
 	Linux OS = "linux"
 	Windows OS = "windows"
 	OSx OS = "darwin"
 	Amd64 Arch = "amd64"
 	I386 Arch = "386"
+	Arm64 Arch = "arm64"
 )
 
+//Every OS and Arch above, in the same order
+var (
+	allOSes = []OS{Linux, Windows, OSx}
+	allArches = []Arch{Amd64, I386, Arm64}
+)
+
+//Combinations of the above that Go can't build for
+var unbuildableSystemTypes = map[SystemType]bool{
+	//Dropped in Go 1.15
+	SystemType{OS: OSx, Arch: I386}: true,
+}
+
+// Procedure:
+//  SupportedSystemTypes
+// Purpose:
+//  To list everything clients can be built for
+// Parameters:
+//  None
+// Produces:
+//  The buildable os/arch combinations: systems []SystemType
+// Preconditions:
+//  No additional
+// Postconditions:
+//  systems is every OS paired with every Arch, in the order they
+//    are defined, minus combinations Go can't build
+//  systems is a new slice on each call
+func SupportedSystemTypes() []SystemType {
+	var systems []SystemType
+	for _, targetOS := range allOSes {
+		for _, targetArch := range allArches {
+			system := SystemType{OS: targetOS, Arch: targetArch}
+			if !unbuildableSystemTypes[system] {
+				systems = append(systems, system)
+			}
+		}
+	}
+	return systems
+}
+
 var (
 	forceSuperuser bool
 	superuserForced bool
@@ -142,6 +217,15 @@ func PrintError(in ...interface{}) {
 	}
 }
 
+//Prints an error to stderr, or the log, without exiting
+func Eprintln(in ...interface{}) {
+	if IsSuperUser() {
+		log.Println(in...)
+	} else {
+		fmt.Fprintln(os.Stderr, in...)
+	}
+}
+
 func Println(in ...interface{}) {
 	if IsSuperUser() {
 		log.Println(in...)